@@ -1,44 +1,507 @@
 package main
 
 import (
-	"github.com/aerospike/aerospike-client-go"
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/phuslu/glog"
 	"github.com/valyala/fasthttp"
 )
 
 type BidHandler struct {
-	AeroSpike *aerospike.Client
+	Store     BidStore
+	Campaigns *CampaignCatalog
+	Region    *RegionResolver
+	Frequency *FrequencyCapper
+	Pacer     *BudgetPacer
+	WinRate   *WinRateTracker
+	Exchanges map[string]*Exchange
+	BidLog    *BidLogger
 	Config    *Config
-}
 
-type BidRequest struct {
-	Token string `json:"token"`
+	deadlineMisses sync.Map // map[string]*int64
 }
 
-type BidResponse struct {
-	Error string      `json:"error,omitempty"`
-	Info  interface{} `json:"info"`
-}
-
-func (h *BidHandler) Error(ctx *fasthttp.RequestCtx, err error) {
-	json.NewEncoder(ctx).Encode(BidResponse{
-		Error: err.Error(),
-	})
-}
+// defaultExchange serves the plain /bid route.
+var defaultExchange = &Exchange{Adapter: OpenRTBAdapter{}}
 
 func (h *BidHandler) Bid(ctx *fasthttp.RequestCtx) {
 	glog.S(2).Str("remote_addr", ctx.RemoteAddr().String()).Bytes("method", ctx.Method()).Str("url", ctx.URI().String()).Bytes("user_agent", ctx.UserAgent())
 
+	ctx.Response.Header.Set("X-Openrtb-Version", "2.5")
+
 	var req BidRequest
 
+	x := defaultExchange
+	if name, ok := ctx.UserValue("exchange").(string); ok {
+		x = h.Exchanges[name]
+		if x == nil {
+			h.logBid(name, &req, "unknown_exchange", nil)
+			WriteError(ctx, &APIError{
+				StatusCode: fasthttp.StatusNotFound,
+				Code:       ErrCodeNotFound,
+				Message:    "unknown exchange",
+			})
+			return
+		}
+	}
+
+	if !x.Authenticate(ctx) {
+		h.logBid(x.Name, &req, "forbidden", nil)
+		WriteError(ctx, &APIError{
+			StatusCode: fasthttp.StatusForbidden,
+			Code:       ErrCodeForbidden,
+			Message:    "exchange authentication failed",
+		})
+		return
+	}
+
 	err := json.Unmarshal(ctx.PostBody(), &req)
+	if err == nil {
+		err = x.Adapter.Normalize(ctx.PostBody(), &req)
+	}
 	if err != nil {
-		h.Error(ctx, err)
+		h.logBid(x.Name, &req, "invalid_request", nil)
+		WriteError(ctx, &APIError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Code:       ErrCodeInvalidRequest,
+			Message:    "request body is not a valid json object",
+			Err:        err,
+		})
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		h.logBid(x.Name, &req, "invalid_request", nil)
+		WriteError(ctx, &APIError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Code:       ErrCodeInvalidRequest,
+			Message:    err.Error(),
+		})
+		return
+	}
+
+	if !h.Store.Health().Connected {
+		glog.Warnings().Str("request_id", req.ID).Msg("bid store is unavailable, no-bid")
+		h.logBid(x.Name, &req, "store_unavailable", nil)
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+
+	bctx := &BidContext{
+		Exchange: x.Name,
+		Seat:     x.Seat,
+		Request:  &req,
+		Now:      time.Now(),
+	}
+
+	deadline := h.deadline(ctx.Time(), &req)
+	if !bctx.Now.Before(deadline) {
+		h.missDeadline(bctx, "request")
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+
+	bidCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	bctx.Context = bidCtx
+
+	h.resolveGeo(ctx, bctx)
+
+	bctx.Profile, err = LoadProfile(bctx.Context, h.Store, h.Config.Bid.ProfileSet, UserID(&req))
+	if err != nil {
+		glog.Warnings().Err(err).Str("request_id", req.ID).Str("user_id", bctx.Profile.ID).Msg("LoadProfile(...) error")
+	}
+	if bctx.Context.Err() != nil {
+		h.missDeadline(bctx, "profile")
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+
+	resp := h.bid(bctx)
+	if bctx.Context.Err() != nil {
+		h.missDeadline(bctx, "auction")
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+	if resp != nil && x.Seat != "" {
+		for i := range resp.SeatBid {
+			resp.SeatBid[i].Seat = x.Seat
+		}
+	}
+
+	resp = x.Adapter.Respond(&req, resp)
+	if resp == nil || len(resp.SeatBid) == 0 || len(resp.SeatBid[0].Bid) == 0 {
+		h.logBid(x.Name, &req, "no_bid", nil)
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
 		return
 	}
 
-	json.NewEncoder(ctx).Encode(BidResponse{
-		Error: "",
-		Info:  h.AeroSpike.GetNodes(),
+	// only the bids kept by the exchange adapter count for the win rate.
+	go h.recordBids(bidPlacements(&req, resp), bctx.Now)
+
+	h.logBid(x.Name, &req, "bid", resp)
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+type HealthResponse struct {
+	Status   string         `json:"status"`
+	BidStore BidStoreHealth `json:"bid_store"`
+}
+
+// Health reports the bid store connection, it returns 503 if bidding is
+// degraded to no-bid.
+func (h *BidHandler) Health(ctx *fasthttp.RequestCtx) {
+	resp := HealthResponse{
+		Status:   "ok",
+		BidStore: h.Store.Health(),
+	}
+
+	ctx.SetContentType("application/json")
+	if !resp.BidStore.Connected {
+		resp.Status = "degraded"
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+// BidContext carries the request and the data gathered for bidding.
+type BidContext struct {
+	Context  context.Context
+	Exchange string
+	Seat     string
+	Currency string
+	Request  *BidRequest
+	Profile  *Profile
+	IP       string
+	Country  string
+	Region   string
+	Now      time.Time
+}
+
+// resolveGeo resolves the device ip of the bid request, or the caller address
+// if it has none, to an ISO-3166-1 alpha-2 country and a region.
+func (h *BidHandler) resolveGeo(ctx *fasthttp.RequestCtx, bctx *BidContext) {
+	req := bctx.Request
+
+	// only IP literals are looked up, a hostname would cost a dns lookup.
+	if req.Device != nil {
+		if ip := net.ParseIP(req.Device.IP); ip != nil {
+			bctx.IP = ip.String()
+		} else if ip := net.ParseIP(req.Device.IPv6); ip != nil {
+			bctx.IP = ip.String()
+		}
+	}
+	if bctx.IP == "" {
+		bctx.IP = ctx.RemoteIP().String()
+	}
+
+	country, region, err := h.Region.LookupRegion(bctx.Context, bctx.IP)
+	if err != nil {
+		glog.Warnings().Err(err).Str("request_id", req.ID).Str("ip", bctx.IP).Msg("LookupRegion(...) error")
+	}
+	if country != "ZZ" {
+		bctx.Country, bctx.Region = country, region
+	}
+
+	glog.Infos().Str("request_id", req.ID).Str("ip", bctx.IP).Str("country", bctx.Country).Str("region", bctx.Region).Msg("bid request")
+}
+
+// deadline returns the time to answer req received at start by, which is its
+// tmax, or DefaultTmax, less the DeadlineMargin of network latency.
+func (h *BidHandler) deadline(start time.Time, req *BidRequest) time.Time {
+	tmax := time.Duration(req.TMax) * time.Millisecond
+	if tmax <= 0 {
+		tmax = time.Duration(h.Config.Bid.DefaultTmax) * time.Millisecond
+	}
+	if tmax <= 0 {
+		tmax = 100 * time.Millisecond
+	}
+
+	margin := time.Duration(h.Config.Bid.DeadlineMargin) * time.Millisecond
+	if margin <= 0 {
+		margin = 20 * time.Millisecond
+	}
+
+	return start.Add(tmax - margin)
+}
+
+// missDeadline counts a no-bid for the deadline exceeded at stage.
+func (h *BidHandler) missDeadline(bctx *BidContext, stage string) {
+	v, _ := h.deadlineMisses.LoadOrStore(stage, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+
+	glog.Warnings().Str("request_id", bctx.Request.ID).Str("exchange", bctx.Exchange).Str("stage", stage).Int("tmax", bctx.Request.TMax).Msg("bid deadline exceeded, no-bid")
+	h.logBid(bctx.Exchange, bctx.Request, "deadline_"+stage, nil)
+}
+
+// logBid records req of exchange with the decision and resp to the bid log.
+func (h *BidHandler) logBid(exchange string, req *BidRequest, decision string, resp *BidResponse) {
+	h.BidLog.Log(&BidLogRecord{
+		Time:      time.Now(),
+		Type:      "bid",
+		Exchange:  exchange,
+		RequestID: req.ID,
+		Decision:  decision,
+		Request:   req,
+		Response:  resp,
+	})
+}
+
+// DeadlineMisses returns the count of no-bids for exceeded deadlines by stage.
+func (h *BidHandler) DeadlineMisses() map[string]int64 {
+	misses := make(map[string]int64)
+	h.deadlineMisses.Range(func(key, value interface{}) bool {
+		misses[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
 	})
+	return misses
+}
+
+// bid returns the bids of bctx, or nil for a no-bid.
+func (h *BidHandler) bid(bctx *BidContext) *BidResponse {
+	req := bctx.Request
+	rates := CurrencyRates(h.Config.Bid.CurrencyRates)
+
+	bctx.Currency = rates.BidCurrency(req)
+	rate, err := rates.rate(bctx.Currency)
+	if bctx.Currency == "" || err != nil {
+		glog.Infos().Str("request_id", req.ID).Str("cur", strings.Join(req.Cur, ",")).Str("reason", "unknown_currency").Msg("no-bid")
+		return nil
+	}
+
+	// frequency caps and pacing of the campaigns checked by this request
+	blocked := make(map[*Campaign]bool)
+
+	var bids []Bid
+	for i := range req.Imp {
+		imp := &req.Imp[i]
+
+		var candidates []*AuctionCandidate
+		for _, li := range h.Campaigns.Match(bctx, imp) {
+			if bctx.Context.Err() != nil {
+				return nil
+			}
+			deal, floor, ok := h.eligible(bctx, imp, li)
+			if !ok {
+				continue
+			}
+			cr := li.Creative(req, imp)
+			if cr == nil {
+				continue
+			}
+			if h.isBlocked(bctx, li.Campaign, blocked) {
+				continue
+			}
+			candidates = append(candidates, &AuctionCandidate{LineItem: li, Creative: cr, Deal: deal, Floor: floor})
+		}
+
+		winner := Auction(candidates)
+		if winner == nil {
+			continue
+		}
+		best := winner.LineItem
+		placement := Placement(req, imp)
+
+		price := best.ECPM()
+		if h.Config.Bid.Shading {
+			price = h.shade(bctx, placement, price, winner.Floor)
+		}
+		// in the bid currency, see FromUSD
+		price /= rate
+
+		cr := winner.Creative
+
+		bid := Bid{
+			ID:      RandomHex(8),
+			ImpID:   imp.ID,
+			Price:   price,
+			AdID:    best.ID,
+			CID:     best.Campaign.ID,
+			CrID:    cr.ID,
+			ADomain: cr.Advertisers(best.Campaign),
+			Cat:     cr.Cat,
+			Attr:    cr.Attr,
+			W:       cr.W,
+			H:       cr.H,
+		}
+		if winner.Deal != nil {
+			bid.DealID = winner.Deal.ID
+		}
+		bid.NURL = h.noticeURL("win", bctx, &bid, placement)
+		bid.LURL = h.noticeURL("loss", bctx, &bid, placement)
+		bid.BURL = h.noticeURL("bill", bctx, &bid, placement)
+
+		bid.AdM = cr.Render(h.creativeMacros(bctx, &bid, cr, placement))
+
+		bids = append(bids, bid)
+	}
+
+	if len(bids) == 0 {
+		return nil
+	}
+
+	return &BidResponse{
+		ID:  req.ID,
+		Cur: bctx.Currency,
+		SeatBid: []SeatBid{
+			{Bid: bids},
+		},
+	}
+}
+
+// eligible reports whether li may bid on imp, the deal it bids in and the
+// floor in USD. A line item targeting deals bids only in those deals which
+// allow the seat of the exchange, others only in the open auction. The eCPM
+// of li must clear the floor of the deal or imp.
+func (h *BidHandler) eligible(bctx *BidContext, imp *Imp, li *LineItem) (*Deal, float64, bool) {
+	var deal *Deal
+	floor, cur := imp.BidFloor, imp.BidFloorCur
+
+	if len(li.Targeting.Deals) > 0 {
+		if imp.PMP == nil {
+			return nil, 0, false
+		}
+		for i := range imp.PMP.Deals {
+			d := &imp.PMP.Deals[i]
+			if HasString(li.Targeting.Deals, d.ID) && (len(d.WSeat) == 0 || HasString(d.WSeat, bctx.Seat)) {
+				deal = d
+				break
+			}
+		}
+		if deal == nil {
+			return nil, 0, false
+		}
+		floor, cur = deal.BidFloor, deal.BidFloorCur
+	} else if imp.PMP != nil && imp.PMP.PrivateAuction == 1 {
+		return nil, 0, false
+	}
+
+	floor, err := CurrencyRates(h.Config.Bid.CurrencyRates).ToUSD(floor, cur)
+	if err != nil {
+		glog.Infos().Err(err).Str("request_id", bctx.Request.ID).Str("imp_id", imp.ID).Msg("bid floor currency error")
+		return nil, 0, false
+	}
+
+	return deal, floor, li.ECPM() >= floor
+}
+
+// shade shades price of a bid on placement by its recent win rate, see
+// ShadePrice.
+func (h *BidHandler) shade(bctx *BidContext, placement string, price, floor float64) float64 {
+	r, err := h.WinRate.WinRate(bctx.Context, placement, bctx.Now)
+	if err != nil {
+		glog.Warnings().Err(err).Str("request_id", bctx.Request.ID).Str("placement", placement).Msg("WinRate.WinRate(...) error")
+		return price
+	}
+	if r.Bids < int64(h.Config.Bid.ShadingMinBids) {
+		return price
+	}
+
+	return ShadePrice(price, floor, r.Rate(), h.Config.Bid.ShadingTargetWinrate, h.Config.Bid.ShadingMinFactor)
+}
+
+// isBlocked reports whether c is frequency capped for the user of bctx or
+// throttled by its budget pacing.
+func (h *BidHandler) isBlocked(bctx *BidContext, c *Campaign, blocked map[*Campaign]bool) bool {
+	if v, ok := blocked[c]; ok {
+		return v
+	}
+
+	ok, err := h.Frequency.Allow(bctx.Context, bctx.Profile.ID, c, bctx.Now)
+	if err != nil {
+		glog.Warnings().Err(err).Str("request_id", bctx.Request.ID).Str("campaign_id", c.ID).Msg("Frequency.Allow(...) error")
+	}
+
+	if ok {
+		ok, err = h.Pacer.Allow(bctx.Context, c, bctx.Now)
+		if err != nil {
+			glog.Warnings().Err(err).Str("request_id", bctx.Request.ID).Str("campaign_id", c.ID).Msg("Pacer.Allow(...) error")
+		}
+	}
+
+	blocked[c] = !ok
+	return !ok
+}
+
+// recordBids counts the bids of placements for their win rates, out of the
+// bidding path.
+func (h *BidHandler) recordBids(placements []string, now time.Time) {
+	storeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, placement := range placements {
+		if err := h.WinRate.Record(storeCtx, placement, "bids", now); err != nil {
+			glog.Warnings().Err(err).Str("placement", placement).Msg("WinRate.Record(...) error")
+			return
+		}
+	}
+}
+
+// creativeMacros returns the macros of cr for bid, the auction id macro of
+// the trackers is left unescaped for the exchange to substitute.
+func (h *BidHandler) creativeMacros(bctx *BidContext, bid *Bid, cr *Creative, placement string) map[string]string {
+	clickURL := h.trackerURL("click", bctx, bid, placement) + "&id="
+	return map[string]string{
+		"CLICK_URL":     clickURL + "${AUCTION_ID}",
+		"CLICK_URL_ESC": url.QueryEscape(clickURL) + "${AUCTION_ID}",
+		"IMP_URL":       h.trackerURL("imp", bctx, bid, placement) + "&id=${AUCTION_ID}",
+		"CREATIVE_ID":   cr.ID,
+		"WIDTH":         strconv.Itoa(cr.W),
+		"HEIGHT":        strconv.Itoa(cr.H),
+		"CACHEBUSTER":   RandomHex(8),
+	}
+}
+
+// bidPlacements returns the placements of the imps of the bids of resp.
+func bidPlacements(req *BidRequest, resp *BidResponse) []string {
+	var placements []string
+	for _, sb := range resp.SeatBid {
+		for _, bid := range sb.Bid {
+			for i := range req.Imp {
+				if req.Imp[i].ID == bid.ImpID {
+					placements = append(placements, Placement(req, &req.Imp[i]))
+					break
+				}
+			}
+		}
+	}
+	return placements
+}
+
+// noticeURL returns the url of the notice endpoint for bid, with the OpenRTB
+// macros the exchange substitutes.
+func (h *BidHandler) noticeURL(notice string, bctx *BidContext, bid *Bid, placement string) string {
+	u := h.trackerURL(notice, bctx, bid, placement) + "&id=${AUCTION_ID}&price=${AUCTION_PRICE}"
+	if notice == "loss" {
+		u += "&loss=${AUCTION_LOSS}"
+	}
+	return u
+}
+
+// trackerURL returns the url of the notice or tracker endpoint for bid with
+// our params only, signed by SignNotice.
+func (h *BidHandler) trackerURL(notice string, bctx *BidContext, bid *Bid, placement string) string {
+	args := url.Values{}
+	args.Set("x", bctx.Exchange)
+	args.Set("bid", bid.ID)
+	args.Set("imp", bid.ImpID)
+	args.Set("cid", bid.CID)
+	args.Set("li", bid.AdID)
+	args.Set("crid", bid.CrID)
+	args.Set("uid", bctx.Profile.ID)
+	args.Set("pl", placement)
+	args.Set("cur", bctx.Currency)
+	args.Set("sig", SignNotice(h.Config.Bid.NoticeSecret, notice, args))
+
+	return h.Config.Bid.NoticeUrl + "/" + notice + "?" + args.Encode()
 }
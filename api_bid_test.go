@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/valyala/fasthttp"
+)
+
+func TestBidHandlerDeadline(t *testing.T) {
+	h := &BidHandler{Config: &Config{}}
+	h.Config.Bid.DefaultTmax = 200
+	h.Config.Bid.DeadlineMargin = 30
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		TMax     int
+		Deadline time.Duration
+	}{
+		{120, 90 * time.Millisecond},
+		{0, 170 * time.Millisecond},
+		{20, -10 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		deadline := h.deadline(start, &BidRequest{TMax: c.TMax})
+		if d := deadline.Sub(start); d != c.Deadline {
+			t.Errorf("deadline(%#v) return %v, not match %v", c.TMax, d, c.Deadline)
+		}
+	}
+}
+
+func TestBidHandlerEligible(t *testing.T) {
+	h := &BidHandler{Config: &Config{}}
+	h.Config.Bid.CurrencyRates = map[string]float64{"EUR": 1.25}
+
+	open := &LineItem{ID: "open", Price: 2}
+	deal := &LineItem{ID: "deal", Price: 3, Targeting: Targeting{Deals: []string{"d1"}}}
+
+	pmp := &PMP{Deals: []Deal{{ID: "d1", BidFloor: 2, BidFloorCur: "EUR", WSeat: []string{"seat1"}}}}
+
+	cases := []struct {
+		Imp    Imp
+		Seat   string
+		Item   *LineItem
+		DealID string
+		OK     bool
+	}{
+		{Imp{ID: "1", BidFloor: 1.5, BidFloorCur: "EUR"}, "", open, "", true},
+		{Imp{ID: "1", BidFloor: 2, BidFloorCur: "EUR"}, "", open, "", false},
+		{Imp{ID: "1", BidFloor: 1, BidFloorCur: "XXX"}, "", open, "", false},
+		{Imp{ID: "1"}, "seat1", deal, "", false},
+		{Imp{ID: "1", PMP: pmp}, "seat1", deal, "d1", true},
+		{Imp{ID: "1", PMP: pmp}, "seat2", deal, "", false},
+		{Imp{ID: "1", PMP: pmp}, "seat1", open, "", true},
+		{Imp{ID: "1", PMP: &PMP{PrivateAuction: 1, Deals: pmp.Deals}}, "seat1", open, "", false},
+	}
+
+	for _, c := range cases {
+		bctx := &BidContext{Seat: c.Seat, Request: &BidRequest{ID: "1"}}
+		d, _, ok := h.eligible(bctx, &c.Imp, c.Item)
+		dealID := ""
+		if d != nil {
+			dealID = d.ID
+		}
+		if ok != c.OK || dealID != c.DealID {
+			t.Errorf("eligible(%#v, %#v) return %#v, %#v, not match %#v, %#v", c.Imp, c.Item.ID, dealID, ok, c.DealID, c.OK)
+		}
+	}
+}
+
+func TestBidHandlerHealth(t *testing.T) {
+	s := &AerospikeBidStore{Config: &Config{}}
+	s.dial = func(host string, port int) (aerospikeClient, error) {
+		return nil, errors.New("dial tcp 10.0.0.7:3000: connection refused")
+	}
+	h := &BidHandler{Store: s}
+
+	backoff := aerospikeMinBackoff
+	s.connect(&backoff)
+
+	ctx := newTestRequestCtx("/health", nil)
+	h.Health(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Health() return %d, not match %d", ctx.Response.StatusCode(), fasthttp.StatusServiceUnavailable)
+	}
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"degraded"`) || strings.Contains(body, "10.0.0.7") {
+		t.Errorf("Health() return %s", body)
+	}
+
+	s.dial = func(host string, port int) (aerospikeClient, error) {
+		return &fakeAerospikeClient{connected: true}, nil
+	}
+	s.connect(&backoff)
+
+	ctx = newTestRequestCtx("/health", nil)
+	h.Health(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || !strings.Contains(string(ctx.Response.Body()), `"ok"`) {
+		t.Errorf("Health() return %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
+
+func TestBidHandlerResolveGeo(t *testing.T) {
+	tree := &IPTree{}
+	tree.AddList(strings.NewReader("127.0.0.0/8\n"), "US-CA")
+	tree.AddList(strings.NewReader("8.8.8.0/24\n"), "US-NY")
+	tree.AddList(strings.NewReader("2001:4860::/32\n"), "US-WA")
+
+	// no Resolver, a dns lookup of a non IP would panic.
+	h := &BidHandler{
+		Region: &RegionResolver{
+			Regions: tree,
+			IPLists: &IPLists{},
+			Cache:   lrucache.NewLRUCache(16),
+		},
+	}
+
+	var cases = []struct {
+		Device *Device
+		IP     string
+		Region string
+	}{
+		{&Device{IP: "8.8.8.8"}, "8.8.8.8", "NY"},
+		{&Device{IPv6: "2001:4860::8888"}, "2001:4860::8888", "WA"},
+		{&Device{IP: "bad.example.com", IPv6: "2001:4860::8888"}, "2001:4860::8888", "WA"},
+		{&Device{IP: "bad.example.com"}, "127.0.0.1", ""},
+		{nil, "127.0.0.1", ""},
+	}
+
+	for i, c := range cases {
+		bctx := &BidContext{
+			Context: context.Background(),
+			Request: &BidRequest{ID: "r1", Device: c.Device},
+		}
+		h.resolveGeo(newTestRequestCtx("/bid", nil), bctx)
+		if bctx.IP != c.IP || bctx.Region != c.Region {
+			t.Errorf("case #%d resolveGeo() return ip=%#v region=%#v, not match %#v %#v", i, bctx.IP, bctx.Region, c.IP, c.Region)
+		}
+	}
+}
+
+func TestBidHandlerLogEarlyExits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bidlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &BidLogger{Dir: dir, MaxSize: 100 << 20, MaxAge: time.Minute, QueueSize: 100}
+	if err := l.Start(); err != nil {
+		t.Fatalf("Start() error: %+v", err)
+	}
+
+	h := &BidHandler{
+		Exchanges: map[string]*Exchange{
+			"x1": {Name: "x1", Adapter: OpenRTBAdapter{}, Secret: "s3cret"},
+		},
+		BidLog: l,
+	}
+
+	cases := []struct {
+		Exchange   string
+		Secret     string
+		Body       string
+		StatusCode int
+		Decision   string
+	}{
+		{"x9", "", `{"id":"r1"}`, fasthttp.StatusNotFound, "unknown_exchange"},
+		{"x1", "", `{"id":"r2"}`, fasthttp.StatusForbidden, "forbidden"},
+		{"x1", "s3cret", `{"id":"r3",`, fasthttp.StatusBadRequest, "invalid_request"},
+		{"x1", "s3cret", `{"id":"r4","imp":[]}`, fasthttp.StatusBadRequest, "invalid_request"},
+	}
+
+	for _, c := range cases {
+		ctx := newTestRequestCtx("/bid/"+c.Exchange, map[string]string{"X-Exchange-Secret": c.Secret})
+		ctx.Request.SetBodyString(c.Body)
+		ctx.SetUserValue("exchange", c.Exchange)
+
+		h.Bid(ctx)
+		if ctx.Response.StatusCode() != c.StatusCode {
+			t.Errorf("Bid(%s) return %d, not match %d", c.Body, ctx.Response.StatusCode(), c.StatusCode)
+		}
+	}
+	l.Close()
+
+	records := readBidLog(t, dir)
+	if len(records) != len(cases) {
+		t.Fatalf("Bid() logged %d records, not match %d", len(records), len(cases))
+	}
+	for i, c := range cases {
+		if r := records[i]; r.Exchange != c.Exchange || r.Decision != c.Decision {
+			t.Errorf("Bid() logged %s %s, not match %s %s", r.Exchange, r.Decision, c.Exchange, c.Decision)
+		}
+	}
+}
+
+func TestBidHandlerCreativeMacros(t *testing.T) {
+	h := &BidHandler{Config: &Config{}}
+	h.Config.Bid.NoticeUrl = "https://bid.example.com"
+	h.Config.Bid.NoticeSecret = "s3cret"
+
+	bctx := &BidContext{Exchange: "x1", Currency: "USD", Profile: &Profile{ID: "u1"}}
+	bid := &Bid{ID: "b1", ImpID: "1", CID: "c1", AdID: "li1", CrID: "cr1"}
+	cr := &Creative{ID: "cr1", W: 300, H: 250}
+
+	macros := h.creativeMacros(bctx, bid, cr, "site:s1:t1")
+
+	// the exchange substitutes the auction id in the markup
+	click := strings.Replace(macros["CLICK_URL"], "${AUCTION_ID}", "a1", 1)
+	esc := strings.Replace(macros["CLICK_URL_ESC"], "${AUCTION_ID}", "a1", 1)
+	if s, err := url.QueryUnescape(esc); err != nil || s != click {
+		t.Errorf("CLICK_URL_ESC unescapes to %#v, not match CLICK_URL %#v", s, click)
+	}
+	if strings.Contains(macros["CLICK_URL"], "AUCTION_PRICE") || strings.Contains(macros["IMP_URL"], "AUCTION_PRICE") {
+		t.Errorf("trackers should not carry the price macro: %v", macros)
+	}
+
+	n := &NoticeHandler{Config: h.Config}
+	for _, typ := range []string{"click", "imp"} {
+		s := strings.Replace(macros[strings.ToUpper(typ)+"_URL"], "${AUCTION_ID}", "a1", 1)
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatalf("url.Parse(%s) error: %+v", s, err)
+		}
+		ctx := newTestRequestCtx(u.RequestURI(), nil)
+		if !n.verify(ctx.QueryArgs(), typ) || u.Query().Get("id") != "a1" {
+			t.Errorf("%s tracker %s is not signed", typ, u)
+		}
+	}
+}
@@ -6,12 +6,22 @@ import (
 	"github.com/valyala/fasthttp"
 )
 
-func Index(ctx *fasthttp.RequestCtx) {
+type IndexHandler struct {
+	Ipinfo *IpinfoHandler
+}
+
+func (h *IndexHandler) Index(ctx *fasthttp.RequestCtx) {
 	host := ctx.Host()
 	fmt.Fprintf(ctx, `Ipinfo lookup:
 
 Usage:
     curl -v -d '{"ip": "1.1.1.1", "token": "42"}' http://%s/ipinfo
+    curl -v -d '{"ip": "1.1.1.1", "token": "42", "rdns": true}' http://%s/ipinfo
+    curl -v -H 'Accept: text/csv' 'http://%s/ipinfo/1.1.1.1?token=42&rdns=1'
+    curl -v -H 'X-Api-Token: 42' http://%s/ipinfo
+
+Upstream:
+    %s circuit breaker %s
 
-`, host)
+`, host, host, host, host, h.Ipinfo.Provider(), h.Ipinfo.Breaker.State())
 }
@@ -1,53 +1,63 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/andybalholm/brotli"
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/phuslu/glog"
 	"github.com/valyala/fasthttp"
+	"golang.org/x/net/html/charset"
 	"golang.org/x/sync/singleflight"
-	"golang.org/x/time/rate"
+	"golang.org/x/text/encoding"
 )
 
-type IpinfoLimiterKey struct {
-	Token string
-}
-
 type IpinfoHandler struct {
 	URL          string
 	Regex        *regexp.Regexp
+	Charset      string
 	Cache        lrucache.Cache
 	CacheTTL     time.Duration
 	Singleflight *singleflight.Group
 	Transport    *http.Transport
+	Resolver     *Resolver
+	IPLists      *IPLists
+	Timeout      time.Duration
+	MaxBodySize  int64
+	Breaker      *CircuitBreaker
 	RateLimit    int
+	RateLimiter  RateLimiter
 	Config       *Config
-
-	m sync.Map // map[LimiterKey]*rate.Limiter
 }
 
 type IpinfoRequest struct {
 	IP    string `json:"ip"`
 	Token string `json:"token"`
+	Rdns  bool   `json:"rdns"`
 }
 
 type IpinfoResponse struct {
-	Error    string `json:"error,omitempty"`
-	Location string `json:"location,omitempty"`
-	ISP      string `json:"isp,omitempty"`
-}
-
-func (h *IpinfoHandler) Error(ctx *fasthttp.RequestCtx, err error) {
-	json.NewEncoder(ctx).Encode(IpinfoResponse{
-		Error: err.Error(),
-	})
+	IP       string   `json:"ip"`
+	Location string   `json:"location,omitempty"`
+	ISP      string   `json:"isp,omitempty"`
+	Hostname string   `json:"hostname,omitempty"`
+	FCrDNS   *bool    `json:"fcrdns,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
 }
 
 func (h *IpinfoHandler) Ipinfo(ctx *fasthttp.RequestCtx) {
@@ -57,26 +67,90 @@ func (h *IpinfoHandler) Ipinfo(ctx *fasthttp.RequestCtx) {
 
 	err := json.Unmarshal(ctx.PostBody(), &req)
 	if err != nil {
-		h.Error(ctx, err)
+		if !h.rateLimit(ctx, req.Token) {
+			return
+		}
+		WriteError(ctx, &APIError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Code:       ErrCodeInvalidRequest,
+			Message:    "request body is not a valid json object",
+			Err:        err,
+		})
 		return
 	}
 
-	limitKey := IpinfoLimiterKey{
-		Token: req.Token,
+	h.ipinfo(ctx, &req)
+}
+
+// IpinfoGet serves GET /ipinfo/:ip and GET /ipinfo for the caller itself,
+// the token is passed by the X-Api-Token header, a bearer Authorization
+// header or the token query argument.
+func (h *IpinfoHandler) IpinfoGet(ctx *fasthttp.RequestCtx) {
+	glog.S(2).Str("remote_addr", ctx.RemoteAddr().String()).Bytes("method", ctx.Method()).Str("url", ctx.URI().String()).Bytes("user_agent", ctx.UserAgent())
+
+	req := IpinfoRequest{
+		Rdns: ctx.QueryArgs().GetBool("rdns"),
+	}
+
+	if ip, ok := ctx.UserValue("ip").(string); ok {
+		req.IP = ip
+	} else {
+		req.IP = ctx.RemoteIP().String()
+	}
+
+	if token := ctx.Request.Header.Peek("X-Api-Token"); len(token) > 0 {
+		req.Token = string(token)
+	} else if auth := ctx.Request.Header.Peek("Authorization"); bytes.HasPrefix(auth, []byte("Bearer ")) {
+		req.Token = string(auth[len("Bearer "):])
+	} else {
+		req.Token = string(ctx.QueryArgs().Peek("token"))
 	}
 
-	v, ok := h.m.Load(limitKey)
-	if !ok {
-		v, _ = h.m.LoadOrStore(limitKey, rate.NewLimiter(rate.Limit(h.RateLimit), h.RateLimit))
+	h.ipinfo(ctx, &req)
+}
+
+// rateLimit sets the RateLimit-* headers of token and writes a 429 when it is
+// over the limit, it runs before any validation so every response has them.
+func (h *IpinfoHandler) rateLimit(ctx *fasthttp.RequestCtx, token string) bool {
+	status, err := h.RateLimiter.Allow(token, h.RateLimit)
+	if err != nil {
+		glog.Errors().Err(err).Str("token", token).Msg("RateLimiter.Allow(...) error")
 	}
 
-	limiter := v.(*rate.Limiter)
-	if !limiter.Allow() {
-		h.Error(ctx, fmt.Errorf("limitKey=%#v over limit", limitKey))
+	ctx.Response.Header.Set("RateLimit-Limit", strconv.Itoa(status.Limit))
+	ctx.Response.Header.Set("RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	ctx.Response.Header.Set("RateLimit-Reset", strconv.Itoa(CeilSeconds(status.Reset)))
+
+	if !status.Allowed {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(CeilSeconds(status.RetryAfter)))
+		WriteError(ctx, &APIError{
+			StatusCode: fasthttp.StatusTooManyRequests,
+			Code:       ErrCodeRateLimited,
+			Message:    "rate limit exceeded",
+		})
+		return false
+	}
+
+	return true
+}
+
+func (h *IpinfoHandler) ipinfo(ctx *fasthttp.RequestCtx, req *IpinfoRequest) {
+	if !h.rateLimit(ctx, req.Token) {
+		return
+	}
+
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		WriteError(ctx, &APIError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Code:       ErrCodeInvalidIP,
+			Message:    "ip is not a valid IPv4 or IPv6 address",
+		})
 		return
 	}
 
 	var item *IpinfoItem
+	var err error
 
 	key := "ipinfo:" + req.IP
 	if v, ok := h.Cache.GetNotStale(key); ok {
@@ -84,49 +158,197 @@ func (h *IpinfoHandler) Ipinfo(ctx *fasthttp.RequestCtx) {
 	} else {
 		item, err = h.ipinfoSearch(req.IP)
 		if err != nil {
-			h.Error(ctx, err)
+			if err == ErrBreakerOpen {
+				WriteError(ctx, &APIError{
+					StatusCode: fasthttp.StatusServiceUnavailable,
+					Code:       ErrCodeServiceUnavailable,
+					Message:    "ipinfo upstream is unavailable",
+					Err:        err,
+				})
+			} else if IsTimeout(err) {
+				WriteError(ctx, &APIError{
+					StatusCode: fasthttp.StatusGatewayTimeout,
+					Code:       ErrCodeUpstreamTimeout,
+					Message:    "ipinfo upstream timeout",
+					Err:        err,
+				})
+			} else {
+				WriteError(ctx, &APIError{
+					StatusCode: fasthttp.StatusBadGateway,
+					Code:       ErrCodeUpstreamError,
+					Message:    "ipinfo upstream error",
+					Err:        err,
+				})
+			}
 			return
 		}
 
-		h.Cache.Set(key, item, time.Now().Add(h.CacheTTL))
+		item.Expires = time.Now().Add(h.CacheTTL)
+		h.Cache.Set(key, item, item.Expires)
 	}
 
-	json.NewEncoder(ctx).Encode(IpinfoResponse{
-		Error:    "",
+	if req.Rdns && !item.Rdns {
+		// copy the cached item, it may be read by other requests concurrently.
+		rdnsItem := *item
+		h.lookupRdns(&rdnsItem, req.IP)
+		item = &rdnsItem
+
+		h.Cache.Set(key, item, item.Expires)
+	}
+
+	format := negotiateFormat(ctx.Request.Header.Peek("Accept"))
+	tags := h.IPLists.Lookup(ip)
+
+	// the tags are in the etag, so a reload of the iplists invalidates it.
+	etag := fmt.Sprintf(`"%x-%x-%x-%t-%s"`, item.Expires.Unix(), fnv32a(req.IP), fnv32a(strings.Join(tags, ",")), req.Rdns, format)
+	maxAge := CeilSeconds(time.Until(item.Expires))
+
+	ctx.Response.Header.Set("ETag", etag)
+	ctx.Response.Header.Set("Cache-Control", "max-age="+strconv.Itoa(maxAge))
+	ctx.Response.Header.Set("Vary", "Accept")
+
+	if inm := ctx.Request.Header.Peek("If-None-Match"); len(inm) > 0 && bytes.Contains(inm, []byte(etag)) {
+		ctx.SetStatusCode(fasthttp.StatusNotModified)
+		return
+	}
+
+	resp := IpinfoResponse{
+		IP:       req.IP,
 		Location: item.Location,
 		ISP:      item.ISP,
-	})
+		Tags:     tags,
+	}
+	if req.Rdns {
+		resp.Hostname = item.Hostname
+		resp.FCrDNS = &item.FCrDNS
+	}
+
+	switch format {
+	case "csv":
+		ctx.SetContentType("text/csv; charset=utf-8")
+		fcrdns := ""
+		if resp.FCrDNS != nil {
+			fcrdns = strconv.FormatBool(*resp.FCrDNS)
+		}
+		w := csv.NewWriter(ctx)
+		w.Write([]string{"ip", "location", "isp", "hostname", "fcrdns", "tags"})
+		w.Write([]string{resp.IP, resp.Location, resp.ISP, resp.Hostname, fcrdns, strings.Join(resp.Tags, ";")})
+		w.Flush()
+	case "text":
+		ctx.SetContentType("text/plain; charset=utf-8")
+		fmt.Fprintf(ctx, "ip: %s\nlocation: %s\nisp: %s\n", resp.IP, resp.Location, resp.ISP)
+		if resp.FCrDNS != nil {
+			fmt.Fprintf(ctx, "hostname: %s\nfcrdns: %t\n", resp.Hostname, *resp.FCrDNS)
+		}
+		if len(resp.Tags) > 0 {
+			fmt.Fprintf(ctx, "tags: %s\n", strings.Join(resp.Tags, ","))
+		}
+	default:
+		ctx.SetContentType("application/json")
+		json.NewEncoder(ctx).Encode(resp)
+	}
+}
+
+// negotiateFormat returns "json", "text" or "csv" by the supported media
+// range of accept with the highest q-value, the first one wins a tie and
+// ranges of q=0 are not acceptable. json is the default.
+func negotiateFormat(accept []byte) string {
+	format, best := "json", 0.0
+	for _, v := range strings.Split(string(accept), ",") {
+		params := strings.Split(v, ";")
+
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if len(p) > 2 && (p[0] == 'q' || p[0] == 'Q') && p[1] == '=' {
+				f, err := strconv.ParseFloat(p[2:], 64)
+				if err != nil || f < 0 || f > 1 {
+					f = 0
+				}
+				q = f
+			}
+		}
+		if q <= best {
+			continue
+		}
+
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "application/json", "*/*", "application/*":
+			format, best = "json", q
+		case "text/plain":
+			format, best = "text", q
+		case "text/csv":
+			format, best = "csv", q
+		}
+	}
+	return format
+}
+
+func fnv32a(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// lookupRdns fills the PTR name of ip into item, and whether the name
+// resolves back to ip. A lookup failure leaves item.Rdns unset so that a
+// later request retries, while a name not found is cached as empty.
+func (h *IpinfoHandler) lookupRdns(item *IpinfoItem, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	names, err := h.Resolver.LookupPTR(ctx, ip)
+	if err != nil {
+		glog.Warnings().Err(err).Str("ip", ip).Msg("LookupPTR(...) error")
+		return
+	}
+
+	item.Rdns = true
+	if len(names) == 0 {
+		return
+	}
+
+	item.Hostname = names[0]
+	item.FCrDNS = h.Resolver.IsForwardConfirmed(ctx, net.ParseIP(ip), item.Hostname)
+}
+
+// Provider returns the host name of the ipinfo upstream.
+func (h *IpinfoHandler) Provider() string {
+	if u, err := url.Parse(h.URL); err == nil {
+		return u.Hostname()
+	}
+	return h.URL
 }
 
 type IpinfoItem struct {
 	Location string
 	ISP      string
+	Expires  time.Time
+
+	Rdns     bool
+	Hostname string
+	FCrDNS   bool
 }
 
 func (h *IpinfoHandler) ipinfoSearch(ipStr string) (*IpinfoItem, error) {
 	url := strings.Replace(h.URL, "%s", ipStr, 1)
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
-	}
+	v, err, _ := h.Singleflight.Do(url, func() (interface{}, error) {
+		if !h.Breaker.Allow() {
+			return nil, ErrBreakerOpen
+		}
 
-	req.Header.Set("User-Agent", "curl/7.56.0")
+		start := time.Now()
+		data, err := h.fetch(url)
+		h.Breaker.Done(err, time.Since(start))
 
-	v, err, _ := h.Singleflight.Do(url, func() (interface{}, error) {
-		return h.Transport.RoundTrip(req)
+		return data, err
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	resp := v.(*http.Response)
-	defer resp.Body.Close()
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	data := v.([]byte)
 
 	match := h.Regex.FindStringSubmatch(string(data))
 	if match == nil {
@@ -140,7 +362,80 @@ func (h *IpinfoHandler) ipinfoSearch(ipStr string) (*IpinfoItem, error) {
 
 	glog.Infos().Str("ip", ipStr).Msgf("ipinfoSearch(...) return %+v", item)
 
-	h.Singleflight.Forget(url)
-
 	return item, nil
 }
+
+func (h *IpinfoHandler) fetch(url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "curl/7.56.0")
+	req.Header.Set("Accept-Encoding", "gzip, br")
+
+	resp, err := h.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ipinfo upstream %s return status %d", url, resp.StatusCode)
+	}
+
+	var r io.Reader = resp.Body
+	switch ce := strings.ToLower(resp.Header.Get("Content-Encoding")); ce {
+	case "", "identity":
+		break
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case "br":
+		r = brotli.NewReader(resp.Body)
+	default:
+		return nil, fmt.Errorf("ipinfo upstream %s return unsupported Content-Encoding %#v", url, ce)
+	}
+
+	// bound the decompressed body, a small compressed one may inflate a lot
+	data, err := ioutil.ReadAll(io.LimitReader(r, h.MaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > h.MaxBodySize {
+		return nil, fmt.Errorf("ipinfo upstream %s return body larger than %d bytes", url, h.MaxBodySize)
+	}
+
+	return decodeHTML(data, resp.Header.Get("Content-Type"), h.Charset)
+}
+
+// decodeHTML transcodes data to UTF-8 by the charset of Content-Type or
+// <meta> tags, fallback is used if neither declares a charset and data is not
+// valid UTF-8.
+func decodeHTML(data []byte, contentType, fallback string) ([]byte, error) {
+	e, name, certain := charset.DetermineEncoding(data, contentType)
+	if !certain && name == "windows-1252" {
+		if utf8.Valid(data) {
+			return data, nil
+		}
+		if fallback != "" {
+			if fe, _ := charset.Lookup(fallback); fe != nil {
+				e = fe
+			}
+		}
+	}
+
+	if e == encoding.Nop {
+		return data, nil
+	}
+
+	return e.NewDecoder().Bytes(data)
+}
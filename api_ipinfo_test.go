@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestDecodeHTML(t *testing.T) {
+	const text = "来自：北京市 联通"
+
+	gbk, err := simplifiedchinese.GBK.NewEncoder().String(text)
+	if err != nil {
+		t.Fatalf("GBK.NewEncoder() error: %+v", err)
+	}
+
+	var cases = []struct {
+		data        string
+		contentType string
+		fallback    string
+	}{
+		{text, "text/html", ""},
+		{gbk, "text/html; charset=gbk", ""},
+		{`<meta charset="gb2312">` + gbk, "text/html", ""},
+		{gbk, "text/html", "gb18030"},
+	}
+
+	for _, c := range cases {
+		data, err := decodeHTML([]byte(c.data), c.contentType, c.fallback)
+		if err != nil {
+			t.Errorf("decodeHTML(%q, %#v, %#v) error: %+v", c.data, c.contentType, c.fallback, err)
+			continue
+		}
+		if s := string(data); s != text && s != `<meta charset="gb2312">`+text {
+			t.Errorf("decodeHTML(%q, %#v, %#v) return %q", c.data, c.contentType, c.fallback, s)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	var cases = []struct {
+		accept string
+		format string
+	}{
+		{"", "json"},
+		{"*/*", "json"},
+		{"text/csv", "csv"},
+		{"text/plain;q=0.9, application/json", "json"},
+		{"text/plain, application/json", "text"},
+		{"application/json;q=0.5, text/csv", "csv"},
+		{"text/html, text/csv;q=0.5", "csv"},
+		{"text/csv;q=0, */*;q=0.1", "json"},
+		{"text/plain; charset=utf-8; q=0.8, text/csv;q=0.2", "text"},
+		{"image/png", "json"},
+	}
+
+	for _, c := range cases {
+		if format := negotiateFormat([]byte(c.accept)); format != c.format {
+			t.Errorf("negotiateFormat(%#v) return %#v, not match %#v", c.accept, format, c.format)
+		}
+	}
+}
+
+func TestIpinfoFetchMaxBodySize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(bytes.Repeat([]byte("a"), 1<<20))
+		gz.Close()
+	}))
+	defer server.Close()
+
+	h := &IpinfoHandler{
+		Transport:   &http.Transport{},
+		Timeout:     5 * time.Second,
+		MaxBodySize: 1 << 20,
+	}
+
+	if _, err := h.fetch(server.URL); err != nil {
+		t.Errorf("fetch() error: %+v", err)
+	}
+
+	h.MaxBodySize = 1024
+	if _, err := h.fetch(server.URL); err == nil {
+		t.Errorf("fetch() should reject a body larger than %d bytes", h.MaxBodySize)
+	}
+}
+
+func TestIpinfoETag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iplist")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "tor.txt")
+	ioutil.WriteFile(filename, []byte("185.220.101.0/24\n"), 0644)
+
+	h := &IpinfoHandler{
+		Cache:       lrucache.NewLRUCache(16),
+		IPLists:     &IPLists{Files: []IPListFile{{Tag: "tor", File: filename}}},
+		RateLimit:   100,
+		RateLimiter: &LocalRateLimiter{Cache: lrucache.NewLRUCache(16), TTL: time.Minute},
+	}
+	if err := h.IPLists.Load(); err != nil {
+		t.Fatalf("Load() error: %+v", err)
+	}
+
+	ip := "1.2.3.4"
+	h.Cache.Set("ipinfo:"+ip, &IpinfoItem{Location: "US", Expires: time.Now().Add(time.Hour)}, time.Now().Add(time.Hour))
+
+	serve := func(inm string) *fasthttp.RequestCtx {
+		ctx := newTestRequestCtx("/ipinfo/"+ip, map[string]string{"If-None-Match": inm})
+		h.ipinfo(ctx, &IpinfoRequest{IP: ip})
+		return ctx
+	}
+
+	etag := string(serve("").Response.Header.Peek("ETag"))
+	if etag == "" {
+		t.Fatalf("ipinfo() should set an ETag")
+	}
+	if ctx := serve(etag); ctx.Response.StatusCode() != fasthttp.StatusNotModified {
+		t.Errorf("ipinfo() with a matched ETag return %d", ctx.Response.StatusCode())
+	}
+
+	ioutil.WriteFile(filename, []byte("1.2.3.0/24\n"), 0644)
+	if err := h.IPLists.Load(); err != nil {
+		t.Fatalf("Load() error: %+v", err)
+	}
+
+	ctx := serve(etag)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("ipinfo() after the iplists changed return %d", ctx.Response.StatusCode())
+	}
+	if !bytes.Contains(ctx.Response.Body(), []byte(`"tor"`)) {
+		t.Errorf("ipinfo() return %s, should have the tor tag", ctx.Response.Body())
+	}
+}
+
+type fakeRateLimiter struct {
+	Status RateLimitStatus
+}
+
+func (l *fakeRateLimiter) Allow(key string, limit int) (RateLimitStatus, error) {
+	return l.Status, nil
+}
+
+func TestIpinfoStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1.2.3.4":
+			w.Write([]byte("location=US isp=ACME"))
+		case "/1.2.3.5":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/1.2.3.6":
+			time.Sleep(500 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	allowed := RateLimitStatus{Allowed: true, Limit: 10, Remaining: 9, Reset: time.Second}
+	limited := RateLimitStatus{Allowed: false, Limit: 10, Remaining: 0, Reset: time.Second, RetryAfter: 2 * time.Second}
+
+	cases := []struct {
+		IP         string
+		Status     RateLimitStatus
+		BreakerOff bool
+		StatusCode int
+		RetryAfter string
+	}{
+		{"1.2.3.4", allowed, false, fasthttp.StatusOK, ""},
+		{"not-an-ip", allowed, false, fasthttp.StatusBadRequest, ""},
+		{"not-an-ip", limited, false, fasthttp.StatusTooManyRequests, "2"},
+		{"1.2.3.4", limited, false, fasthttp.StatusTooManyRequests, "2"},
+		{"1.2.3.5", allowed, false, fasthttp.StatusBadGateway, ""},
+		{"1.2.3.4", allowed, true, fasthttp.StatusServiceUnavailable, ""},
+		{"1.2.3.6", allowed, false, fasthttp.StatusGatewayTimeout, ""},
+	}
+
+	for _, c := range cases {
+		h := &IpinfoHandler{
+			URL:          server.URL + "/%s",
+			Regex:        regexp.MustCompile(`location=(\w+) isp=(\w+)`),
+			Cache:        lrucache.NewLRUCache(16),
+			CacheTTL:     time.Minute,
+			Singleflight: &singleflight.Group{},
+			Transport:    &http.Transport{},
+			IPLists:      &IPLists{},
+			Timeout:      100 * time.Millisecond,
+			MaxBodySize:  1 << 20,
+			Breaker:      &CircuitBreaker{FailureThreshold: 1, OpenTimeout: time.Hour},
+			RateLimit:    10,
+			RateLimiter:  &fakeRateLimiter{Status: c.Status},
+		}
+		if c.BreakerOff {
+			h.Breaker.Done(errors.New("failed"), 0)
+		}
+
+		ctx := newTestRequestCtx("/ipinfo/"+c.IP, nil)
+		h.ipinfo(ctx, &IpinfoRequest{IP: c.IP})
+
+		if got := ctx.Response.StatusCode(); got != c.StatusCode {
+			t.Errorf("ipinfo(%#v) return %d, not match %d", c.IP, got, c.StatusCode)
+		}
+		for key, value := range map[string]string{
+			"RateLimit-Limit":     "10",
+			"RateLimit-Remaining": strconv.Itoa(c.Status.Remaining),
+			"RateLimit-Reset":     "1",
+			"Retry-After":         c.RetryAfter,
+		} {
+			if got := string(ctx.Response.Header.Peek(key)); got != value {
+				t.Errorf("ipinfo(%#v) return %s %#v, not match %#v", c.IP, key, got, value)
+			}
+		}
+	}
+}
+
+func TestIpinfoInvalidBody(t *testing.T) {
+	h := &IpinfoHandler{
+		RateLimit:   10,
+		RateLimiter: &fakeRateLimiter{Status: RateLimitStatus{Allowed: true, Limit: 10, Remaining: 9, Reset: time.Second}},
+	}
+
+	ctx := newTestRequestCtx("/ipinfo", nil)
+	ctx.Request.SetBody([]byte("{"))
+	h.Ipinfo(ctx)
+
+	if got := ctx.Response.StatusCode(); got != fasthttp.StatusBadRequest {
+		t.Errorf("Ipinfo() return %d, not match %d", got, fasthttp.StatusBadRequest)
+	}
+	if got := string(ctx.Response.Header.Peek("RateLimit-Remaining")); got != "9" {
+		t.Errorf("Ipinfo() return RateLimit-Remaining %#v, not match %#v", got, "9")
+	}
+}
+
+func TestIpinfoLookupRdns(t *testing.T) {
+	dns := newTestFakeDNS(t)
+	defer dns.conn.Close()
+
+	h := &IpinfoHandler{
+		Resolver: dns.Resolver(),
+		Timeout:  5 * time.Second,
+	}
+
+	cases := []struct {
+		IP       string
+		Rdns     bool
+		Hostname string
+		FCrDNS   bool
+	}{
+		{"192.0.2.4", true, "host.example.com", true},
+		{"192.0.2.5", true, "spoof.example.com", false},
+		// not found is cached
+		{"192.0.2.6", true, "", false},
+		// a failure is retried by a later request
+		{"192.0.2.7", false, "", false},
+	}
+
+	for _, c := range cases {
+		var item IpinfoItem
+		h.lookupRdns(&item, c.IP)
+		if item.Rdns != c.Rdns || item.Hostname != c.Hostname || item.FCrDNS != c.FCrDNS {
+			t.Errorf("lookupRdns(%#v) return %+v, not match %#v %#v %#v", c.IP, item, c.Rdns, c.Hostname, c.FCrDNS)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/glog"
+	"github.com/valyala/fasthttp"
+)
+
+// NoticeHandler serves the notification urls of bids, see BidHandler.noticeURL.
+// Notices must carry the "sig" of SignNotice, they are de-duplicated by bid id
+// in the "n" bin of NoticeSet records, and encrypted prices are rejected when
+// their nonce is seen again within a week. The impression of a bid is charged
+// by the notice of the SpendOn of its exchange.
+type NoticeHandler struct {
+	Store      BidStore
+	Campaigns  *CampaignCatalog
+	Exchanges  map[string]*Exchange
+	Frequency  *FrequencyCapper
+	Pacer      *BudgetPacer
+	WinRate    *WinRateTracker
+	Decrypters map[string]PriceDecrypter
+	BidLog     *BidLogger
+	Config     *Config
+
+	counts NoticeCounts
+}
+
+// NoticeCounts is the count of notices served by type.
+type NoticeCounts struct {
+	Win       int64
+	Loss      int64
+	Bill      int64
+	Duplicate int64
+	Replay    int64
+}
+
+// Notice is a parsed notification of a bid.
+type Notice struct {
+	Type       string
+	Exchange   string
+	BidID      string
+	AuctionID  string
+	ImpID      string
+	Campaign   *Campaign
+	LineItemID string
+	CreativeID string
+	UserID     string
+	Placement  string
+	Price      float64
+	Nonce      string
+	LossReason int
+}
+
+// noticeParams are the query params of notice urls set by the bidder, the
+// macros of the exchange are not signed.
+var noticeParams = []string{"x", "bid", "imp", "cid", "li", "crid", "uid", "pl", "cur"}
+
+// SignNotice returns the websafe base64 HMAC-SHA256 by secret of the notice
+// type and the noticeParams of args, it is the "sig" param of notice urls.
+func SignNotice(secret, typ string, args url.Values) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, typ)
+	for _, k := range noticeParams {
+		io.WriteString(mac, "&"+k+"="+url.QueryEscape(args.Get(k)))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify reports whether the "sig" param of args signs the notice of typ.
+func (h *NoticeHandler) verify(args *fasthttp.Args, typ string) bool {
+	secret := h.Config.Bid.NoticeSecret
+	if secret == "" {
+		return false
+	}
+
+	values := url.Values{}
+	for _, k := range noticeParams {
+		values.Set(k, string(args.Peek(k)))
+	}
+
+	return hmac.Equal(args.Peek("sig"), []byte(SignNotice(secret, typ, values)))
+}
+
+// Win serves the win notice of a bid, it counts the win of the placement and
+// charges the impression unless the exchange bills it by the billing notice.
+func (h *NoticeHandler) Win(ctx *fasthttp.RequestCtx) {
+	h.serve(ctx, "win", &h.counts.Win, func(storeCtx context.Context, n *Notice, now time.Time) error {
+		if h.spendOn(n.Exchange) == "win" {
+			if err := h.charge(storeCtx, n, now); err != nil {
+				return err
+			}
+		}
+		return h.WinRate.Record(storeCtx, n.Placement, "wins", now)
+	})
+}
+
+// Loss serves the loss notice of a bid, it counts the loss of the placement.
+func (h *NoticeHandler) Loss(ctx *fasthttp.RequestCtx) {
+	h.serve(ctx, "loss", &h.counts.Loss, func(storeCtx context.Context, n *Notice, now time.Time) error {
+		glog.Infos().Str("bid_id", n.BidID).Str("auction_id", n.AuctionID).Int("reason", n.LossReason).Str("price", strconv.FormatFloat(n.Price, 'f', -1, 64)).Msg("bid lost")
+		return h.WinRate.Record(storeCtx, n.Placement, "losses", now)
+	})
+}
+
+// Bill serves the billing notice of a bid, which is fired by the exchange
+// when the impression is rendered. It charges the impression of exchanges
+// which spend on "bill".
+func (h *NoticeHandler) Bill(ctx *fasthttp.RequestCtx) {
+	h.serve(ctx, "bill", &h.counts.Bill, func(storeCtx context.Context, n *Notice, now time.Time) error {
+		if h.spendOn(n.Exchange) != "bill" {
+			return nil
+		}
+		return h.charge(storeCtx, n, now)
+	})
+}
+
+// spendOn returns the notice type which charges the impressions of exchange,
+// it is "win" for the plain /bid route and unknown exchanges.
+func (h *NoticeHandler) spendOn(exchange string) string {
+	if x := h.Exchanges[exchange]; x != nil && x.SpendOn != "" {
+		return x.SpendOn
+	}
+	return "win"
+}
+
+// charge counts the impression of n against the frequency caps of the
+// campaign and its clearing price against the budget. Both are counted once
+// per bid, so the retry of a notice whose spend failed to record, or a win
+// and bill of the same bid, do not count them again.
+func (h *NoticeHandler) charge(storeCtx context.Context, n *Notice, now time.Time) error {
+	key := "frequency:" + n.BidID
+	bins, err := h.Store.Get(storeCtx, h.Config.Bid.NoticeSet, key)
+	if err != nil {
+		return err
+	}
+	if bins == nil {
+		if err := h.Frequency.Record(storeCtx, n.UserID, n.Campaign, now); err != nil {
+			return err
+		}
+		if err := h.Store.Put(storeCtx, h.Config.Bid.NoticeSet, key, map[string]interface{}{"n": 1}, 24*time.Hour); err != nil {
+			glog.Warnings().Err(err).Str("bid_id", n.BidID).Msg("Store.Put(...) of recorded frequency error")
+		}
+	}
+	return h.Pacer.Record(storeCtx, n.Campaign, n.BidID, n.Price, now)
+}
+
+// transparentGIF is a 1x1 transparent gif.
+var transparentGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// Imp serves the impression tracker of creatives, a transparent pixel.
+func (h *NoticeHandler) Imp(ctx *fasthttp.RequestCtx) {
+	if !h.track(ctx, "imp") {
+		return
+	}
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.SetContentType("image/gif")
+	ctx.Write(transparentGIF)
+}
+
+// Click serves the click tracker of creatives, it redirects to the click url
+// of the creative.
+func (h *NoticeHandler) Click(ctx *fasthttp.RequestCtx) {
+	cr := h.Campaigns.Creative(string(ctx.QueryArgs().Peek("crid")))
+	if cr == nil || cr.ClickURL == "" {
+		WriteError(ctx, &APIError{
+			StatusCode: fasthttp.StatusNotFound,
+			Code:       ErrCodeNotFound,
+			Message:    "unknown creative",
+		})
+		return
+	}
+
+	if !h.track(ctx, "click") {
+		return
+	}
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.Redirect(cr.ClickURL, fasthttp.StatusFound)
+}
+
+// track records the tracker of typ to the bid log, it writes the error and
+// returns false if the tracker is not signed.
+func (h *NoticeHandler) track(ctx *fasthttp.RequestCtx, typ string) bool {
+	glog.S(2).Str("remote_addr", ctx.RemoteAddr().String()).Bytes("method", ctx.Method()).Str("url", ctx.URI().String()).Bytes("user_agent", ctx.UserAgent())
+
+	args := ctx.QueryArgs()
+
+	if !h.verify(args, typ) {
+		WriteError(ctx, &APIError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Code:       ErrCodeInvalidRequest,
+			Message:    "missing or invalid signature",
+		})
+		return false
+	}
+
+	h.BidLog.Log(&BidLogRecord{
+		Time:      time.Now(),
+		Type:      typ,
+		Exchange:  string(args.Peek("x")),
+		RequestID: string(args.Peek("id")),
+		BidID:     string(args.Peek("bid")),
+		Campaign:  string(args.Peek("cid")),
+		LineItem:  string(args.Peek("li")),
+		Creative:  string(args.Peek("crid")),
+	})
+
+	return true
+}
+
+// Counts returns the count of notices served by type.
+func (h *NoticeHandler) Counts() NoticeCounts {
+	return NoticeCounts{
+		Win:       atomic.LoadInt64(&h.counts.Win),
+		Loss:      atomic.LoadInt64(&h.counts.Loss),
+		Bill:      atomic.LoadInt64(&h.counts.Bill),
+		Duplicate: atomic.LoadInt64(&h.counts.Duplicate),
+		Replay:    atomic.LoadInt64(&h.counts.Replay),
+	}
+}
+
+func (h *NoticeHandler) serve(ctx *fasthttp.RequestCtx, typ string, counter *int64, apply func(context.Context, *Notice, time.Time) error) {
+	glog.S(2).Str("remote_addr", ctx.RemoteAddr().String()).Bytes("method", ctx.Method()).Str("url", ctx.URI().String()).Bytes("user_agent", ctx.UserAgent())
+
+	n, apierr := h.parse(ctx, typ)
+	if apierr != nil {
+		WriteError(ctx, apierr)
+		return
+	}
+
+	storeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	key := typ + ":" + n.BidID
+
+	count, err := h.Store.Incr(storeCtx, h.Config.Bid.NoticeSet, key, "n", 1, 24*time.Hour)
+	if err == nil && count > 1 {
+		atomic.AddInt64(&h.counts.Duplicate, 1)
+		glog.Infos().Str("type", typ).Str("bid_id", n.BidID).Msg("duplicate notice")
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+		return
+	}
+
+	nonceKey := typ + ":nonce:" + n.Nonce
+	if err == nil && n.Nonce != "" {
+		count, err = h.Store.Incr(storeCtx, h.Config.Bid.NoticeSet, nonceKey, "n", 1, 7*24*time.Hour)
+		if err == nil && count > 1 {
+			atomic.AddInt64(&h.counts.Replay, 1)
+			WriteError(ctx, &APIError{
+				StatusCode: fasthttp.StatusBadRequest,
+				Code:       ErrCodeInvalidRequest,
+				Message:    "replayed clearing price",
+			})
+			return
+		}
+	}
+
+	if err == nil {
+		err = apply(storeCtx, n, time.Now())
+		if err != nil {
+			// let the retry of the exchange through
+			h.Store.Incr(storeCtx, h.Config.Bid.NoticeSet, key, "n", -1, 24*time.Hour)
+			if n.Nonce != "" {
+				h.Store.Incr(storeCtx, h.Config.Bid.NoticeSet, nonceKey, "n", -1, 7*24*time.Hour)
+			}
+		}
+	}
+	if err != nil {
+		WriteError(ctx, &APIError{
+			StatusCode: fasthttp.StatusServiceUnavailable,
+			Code:       ErrCodeServiceUnavailable,
+			Message:    "bid store unavailable",
+			Err:        err,
+		})
+		return
+	}
+
+	atomic.AddInt64(counter, 1)
+
+	h.BidLog.Log(&BidLogRecord{
+		Time:      time.Now(),
+		Type:      typ,
+		Exchange:  n.Exchange,
+		RequestID: n.AuctionID,
+		BidID:     n.BidID,
+		Campaign:  n.Campaign.ID,
+		LineItem:  n.LineItemID,
+		Creative:  n.CreativeID,
+		Price:     n.Price,
+		Loss:      n.LossReason,
+	})
+
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+func (h *NoticeHandler) parse(ctx *fasthttp.RequestCtx, typ string) (*Notice, *APIError) {
+	args := ctx.QueryArgs()
+
+	if !h.verify(args, typ) {
+		return nil, &APIError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Code:       ErrCodeInvalidRequest,
+			Message:    "missing or invalid signature",
+		}
+	}
+
+	n := &Notice{
+		Type:       typ,
+		Exchange:   string(args.Peek("x")),
+		BidID:      string(args.Peek("bid")),
+		AuctionID:  string(args.Peek("id")),
+		ImpID:      string(args.Peek("imp")),
+		Campaign:   h.Campaigns.Campaign(string(args.Peek("cid"))),
+		LineItemID: string(args.Peek("li")),
+		CreativeID: string(args.Peek("crid")),
+		UserID:     string(args.Peek("uid")),
+		Placement:  string(args.Peek("pl")),
+	}
+
+	if n.BidID == "" {
+		return nil, &APIError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Code:       ErrCodeInvalidRequest,
+			Message:    "missing bid id",
+		}
+	}
+
+	if n.Campaign == nil {
+		return nil, &APIError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Code:       ErrCodeInvalidRequest,
+			Message:    "unknown campaign",
+		}
+	}
+
+	// the exchange is signed, so a notice can not pick the decrypter of another.
+	decrypter, ok := h.Decrypters[n.Exchange]
+	if !ok {
+		return nil, &APIError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Code:       ErrCodeInvalidRequest,
+			Message:    "no price key of exchange",
+		}
+	}
+
+	price, nonce, err := decrypter.DecryptPrice(string(args.Peek("price")))
+	if err == nil {
+		// the clearing price is in the currency of the bid
+		price, err = CurrencyRates(h.Config.Bid.CurrencyRates).ToUSD(price, string(args.Peek("cur")))
+	}
+	switch {
+	case err == nil:
+		n.Price, n.Nonce = price, nonce
+	case typ != "loss":
+		// the clearing price of a loss is optional
+		return nil, &APIError{
+			StatusCode: fasthttp.StatusBadRequest,
+			Code:       ErrCodeInvalidRequest,
+			Message:    "invalid clearing price",
+			Err:        err,
+		}
+	}
+
+	if typ == "loss" {
+		n.LossReason, _ = strconv.Atoi(string(args.Peek("loss")))
+	}
+
+	return n, nil
+}
+
+// Spend serves the spend and pacing of all campaigns.
+func (h *NoticeHandler) Spend(ctx *fasthttp.RequestCtx) {
+	storeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	spends := make([]*CampaignSpend, 0)
+	for _, c := range h.Campaigns.Campaigns() {
+		s, err := h.Pacer.Spend(storeCtx, c, now)
+		if err != nil {
+			WriteError(ctx, &APIError{
+				StatusCode: fasthttp.StatusServiceUnavailable,
+				Code:       ErrCodeServiceUnavailable,
+				Message:    "bid store unavailable",
+				Err:        err,
+			})
+			return
+		}
+		spends = append(spends, s)
+	}
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(spends)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/valyala/fasthttp"
+)
+
+// failingBidStore fails the writes to set, or only to key of set if it is
+// not empty, while fails is positive.
+type failingBidStore struct {
+	BidStore
+	set   string
+	key   string
+	fails int
+}
+
+func (s *failingBidStore) Incr(ctx context.Context, set, key, bin string, delta int64, ttl time.Duration) (int64, error) {
+	if set == s.set && (s.key == "" || key == s.key) && s.fails > 0 {
+		s.fails--
+		return 0, errors.New("store timeout")
+	}
+	return s.BidStore.Incr(ctx, set, key, bin, delta, ttl)
+}
+
+func newTestNoticeHandler(t *testing.T, store BidStore) *NoticeHandler {
+	x, err := newCampaignIndex([]*Campaign{{
+		ID:            "c1",
+		FrequencyCaps: []FrequencyCap{{Count: 3, Period: 3600}},
+	}})
+	if err != nil {
+		t.Fatalf("newCampaignIndex() error: %+v", err)
+	}
+
+	campaigns := &CampaignCatalog{}
+	campaigns.index.Store(x)
+
+	h := &NoticeHandler{
+		Store:     store,
+		Campaigns: campaigns,
+		Exchanges: map[string]*Exchange{
+			"": {SpendOn: "bill"},
+		},
+		Frequency: &FrequencyCapper{Store: store, Set: "frequency"},
+		Pacer:     &BudgetPacer{Store: store, Set: "spend", Cache: lrucache.NewLRUCache(16), CacheTTL: time.Second},
+		WinRate:   &WinRateTracker{Store: store, Set: "winrate", Window: time.Hour, Cache: lrucache.NewLRUCache(16), CacheTTL: time.Second},
+		Config:    &Config{},
+		Decrypters: map[string]PriceDecrypter{
+			"": PlainPriceDecrypter{},
+		},
+	}
+	h.Config.Bid.NoticeSet = "notice"
+	h.Config.Bid.NoticeSecret = "s3cret"
+
+	return h
+}
+
+// noticeURI returns the notice uri of typ with params signed by secret, and
+// the unsigned params of the exchange.
+func noticeURI(secret, typ string, params, macros url.Values) string {
+	args := url.Values{}
+	for k, v := range params {
+		args[k] = v
+	}
+	args.Set("sig", SignNotice(secret, typ, params))
+	return "/" + typ + "?" + args.Encode() + "&" + macros.Encode()
+}
+
+// nonceDecrypter takes the price in plain text and returns it as the nonce.
+type nonceDecrypter struct{}
+
+func (nonceDecrypter) DecryptPrice(s string) (float64, string, error) {
+	price, err := strconv.ParseFloat(s, 64)
+	return price, s, err
+}
+
+func TestNoticeHandlerVerify(t *testing.T) {
+	h := newTestNoticeHandler(t, NewMemoryBidStore())
+
+	params := url.Values{"x": {"x1"}, "bid": {"b1"}, "cid": {"c1"}, "uid": {"u1"}, "cur": {"USD"}}
+	sig := SignNotice("s3cret", "win", params)
+
+	cases := []struct {
+		URI   string
+		Valid bool
+	}{
+		{"/win?x=x1&bid=b1&cid=c1&uid=u1&cur=USD&sig=" + sig + "&id=a1&price=1", true},
+		{"/win?x=x1&bid=b1&cid=c1&uid=u1&cur=USD&id=a1&price=1", false},
+		{"/win?x=x1&bid=b1&cid=c1&uid=u1&cur=USD&sig=&price=1", false},
+		{"/win?x=x1&bid=b2&cid=c1&uid=u1&cur=USD&sig=" + sig, false},
+		{"/win?x=x2&bid=b1&cid=c1&uid=u1&cur=USD&sig=" + sig, false},
+		{"/win?x=x1&bid=b1&cid=c1&uid=u2&cur=USD&sig=" + sig, false},
+		{"/win?x=x1&bid=b1&cid=c1&uid=u1&cur=EUR&sig=" + sig, false},
+		{"/win?x=x1&bid=b1&cid=c1&uid=u1&cur=USD&pl=site:1&sig=" + sig, false},
+	}
+
+	for _, c := range cases {
+		ctx := newTestRequestCtx(c.URI, nil)
+		if valid := h.verify(ctx.QueryArgs(), "win"); valid != c.Valid {
+			t.Errorf("verify(%#v) return %v, not match %v", c.URI, valid, c.Valid)
+		}
+	}
+
+	ctx := newTestRequestCtx(cases[0].URI, nil)
+	if h.verify(ctx.QueryArgs(), "bill") {
+		t.Errorf("verify() should reject the signature of another notice type")
+	}
+
+	h.Config.Bid.NoticeSecret = ""
+	if h.verify(ctx.QueryArgs(), "win") {
+		t.Errorf("verify() should reject all notices without a secret")
+	}
+}
+
+func TestNoticeHandlerServe(t *testing.T) {
+	store := &failingBidStore{BidStore: NewMemoryBidStore(), set: "winrate"}
+	h := newTestNoticeHandler(t, store)
+	h.Decrypters = map[string]PriceDecrypter{"x1": nonceDecrypter{}}
+
+	win := func(bidID, price string) int {
+		params := url.Values{"x": {"x1"}, "bid": {bidID}, "cid": {"c1"}, "pl": {"site:1:t1"}, "cur": {"USD"}}
+		ctx := newTestRequestCtx(noticeURI("s3cret", "win", params, url.Values{"id": {"a1"}, "price": {price}}), nil)
+		h.Win(ctx)
+		return ctx.Response.StatusCode()
+	}
+
+	if code := win("b1", "1.5"); code != fasthttp.StatusNoContent {
+		t.Fatalf("Win() return %d", code)
+	}
+
+	// duplicate of b1
+	if code := win("b1", "1.5"); code != fasthttp.StatusNoContent {
+		t.Errorf("Win() of a duplicate return %d", code)
+	}
+
+	// the clearing price of b1 replayed for b2
+	if code := win("b2", "1.5"); code != fasthttp.StatusBadRequest {
+		t.Errorf("Win() of a replayed price return %d", code)
+	}
+
+	// the store fails, and the retry of the exchange goes through
+	store.fails = 1
+	if code := win("b3", "2.5"); code != fasthttp.StatusServiceUnavailable {
+		t.Errorf("Win() with a failed store return %d", code)
+	}
+	if code := win("b3", "2.5"); code != fasthttp.StatusNoContent {
+		t.Errorf("Win() retry return %d", code)
+	}
+
+	counts := h.Counts()
+	if counts.Win != 2 || counts.Duplicate != 1 || counts.Replay != 1 {
+		t.Errorf("Counts() return %+v", counts)
+	}
+
+	if rate, err := h.WinRate.WinRate(context.Background(), "site:1:t1", time.Now()); err != nil || rate.Wins != 2 {
+		t.Errorf("WinRate() return %+v, %+v", rate, err)
+	}
+}
+
+func TestNoticeHandlerBillRetry(t *testing.T) {
+	store := &failingBidStore{BidStore: NewMemoryBidStore(), set: "spend", fails: 1}
+	h := newTestNoticeHandler(t, store)
+
+	uri := noticeURI("s3cret", "bill", url.Values{"bid": {"b1"}, "cid": {"c1"}, "uid": {"u1"}}, url.Values{"price": {"1.5"}})
+
+	ctx := newTestRequestCtx(uri, nil)
+	h.Bill(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("Bill() with a failed spend record return %d", ctx.Response.StatusCode())
+	}
+
+	ctx = newTestRequestCtx(uri, nil)
+	h.Bill(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("Bill() retry return %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	c := h.Campaigns.Campaign("c1")
+	key := h.Frequency.key("u1", "c1", c.FrequencyCaps[0], time.Now())
+	if bins, _ := store.Get(context.Background(), "frequency", key); ToInt64(bins["n"]) != 1 {
+		t.Errorf("frequency of the retried bill is %v, not match 1", bins["n"])
+	}
+
+	spend, err := h.Pacer.Spend(context.Background(), c, time.Now())
+	if err != nil || spend.TotalSpend != 0.0015 {
+		t.Errorf("Spend() of the retried bill return %+v, %+v", spend, err)
+	}
+}
+
+func TestNoticeHandlerSpendOn(t *testing.T) {
+	h := newTestNoticeHandler(t, NewMemoryBidStore())
+	h.Decrypters["x1"] = PlainPriceDecrypter{}
+
+	c := h.Campaigns.Campaign("c1")
+
+	notice := func(handler fasthttp.RequestHandler, typ, exchange, bidID string) {
+		params := url.Values{"x": {exchange}, "bid": {bidID}, "cid": {"c1"}, "uid": {"u1"}}
+		ctx := newTestRequestCtx(noticeURI("s3cret", typ, params, url.Values{"price": {"2"}}), nil)
+		handler(ctx)
+		if ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+			t.Fatalf("%s notice of %s return %d %s", typ, bidID, ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+	}
+
+	cases := []struct {
+		Handler    fasthttp.RequestHandler
+		Type       string
+		Exchange   string
+		BidID      string
+		TotalSpend float64
+		Frequency  int64
+	}{
+		// x1 spends on win, and the bill of the same bid is not charged again
+		{h.Win, "win", "x1", "b1", 0.002, 1},
+		{h.Bill, "bill", "x1", "b1", 0.002, 1},
+		// the exchange "" spends on bill
+		{h.Win, "win", "", "b2", 0.002, 1},
+		{h.Bill, "bill", "", "b2", 0.004, 2},
+	}
+
+	for _, cc := range cases {
+		notice(cc.Handler, cc.Type, cc.Exchange, cc.BidID)
+
+		spend, err := h.Pacer.Spend(context.Background(), c, time.Now())
+		if err != nil || spend.TotalSpend != cc.TotalSpend {
+			t.Errorf("Spend() after the %s notice of %s return %+v, %+v, not match %v", cc.Type, cc.BidID, spend, err, cc.TotalSpend)
+		}
+
+		key := h.Frequency.key("u1", "c1", c.FrequencyCaps[0], time.Now())
+		if bins, _ := h.Store.Get(context.Background(), "frequency", key); ToInt64(bins["n"]) != cc.Frequency {
+			t.Errorf("frequency after the %s notice of %s is %v, not match %v", cc.Type, cc.BidID, bins["n"], cc.Frequency)
+		}
+	}
+}
+
+func TestNoticeHandlerPriceKey(t *testing.T) {
+	h := newTestNoticeHandler(t, NewMemoryBidStore())
+
+	google, err := NewPriceDecrypter(PriceKey{
+		Exchange:      "google",
+		Scheme:        "google",
+		EncryptionKey: "skU7Ax_NL5pPAFyKdkfZjZz2-VhIN8bjj1rVFOaJ_5o=",
+		IntegrityKey:  "arO23ykdNqUQ5LEoQ0FVmPkBd7xB5CO89PDZlSjpFxo=",
+	})
+	if err != nil {
+		t.Fatalf("NewPriceDecrypter() error: %+v", err)
+	}
+	h.Decrypters["google"] = google
+	h.Decrypters["plain"] = PlainPriceDecrypter{}
+
+	bill := func(exchange, bidID, price string) int {
+		params := url.Values{"x": {exchange}, "bid": {bidID}, "cid": {"c1"}}
+		ctx := newTestRequestCtx(noticeURI("s3cret", "bill", params, url.Values{"price": {price}}), nil)
+		h.Bill(ctx)
+		return ctx.Response.StatusCode()
+	}
+
+	const price = "YWJjMTIzZGVmNDU2Z2hpN7fhCuPemCAWJRxOgA"
+
+	if code := bill("google", "b1", price); code != fasthttp.StatusNoContent {
+		t.Fatalf("Bill() of an encrypted price return %d", code)
+	}
+	if code := bill("google", "b2", price); code != fasthttp.StatusBadRequest {
+		t.Errorf("Bill() of the same encrypted price for another bid return %d", code)
+	}
+	if code := bill("google", "b3", "1.5"); code != fasthttp.StatusBadRequest {
+		t.Errorf("Bill() of a clear price to an encrypted exchange return %d", code)
+	}
+	if code := bill("unknown", "b4", "1.5"); code != fasthttp.StatusBadRequest {
+		t.Errorf("Bill() of an exchange without price key return %d", code)
+	}
+	if code := bill("plain", "b5", "1.5"); code != fasthttp.StatusNoContent {
+		t.Errorf("Bill() of a plain exchange return %d", code)
+	}
+
+	// the signed google notice switched to the plain exchange
+	params := url.Values{"x": {"google"}, "bid": {"b6"}, "cid": {"c1"}}
+	sig := SignNotice("s3cret", "bill", params)
+	ctx := newTestRequestCtx("/bill?x=plain&bid=b6&cid=c1&sig="+sig+"&price=1.5", nil)
+	h.Bill(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Bill() of a notice with a switched exchange return %d", ctx.Response.StatusCode())
+	}
+
+	if counts := h.Counts(); counts.Bill != 2 || counts.Replay != 1 {
+		t.Errorf("Counts() return %+v", counts)
+	}
+}
+
+func TestNoticeHandlerCurrency(t *testing.T) {
+	h := newTestNoticeHandler(t, NewMemoryBidStore())
+	h.Config.Bid.CurrencyRates = map[string]float64{"EUR": 1.25, "JPY": 0.01}
+
+	params := url.Values{"bid": {"b1"}, "cid": {"c1"}, "cur": {"EUR"}}
+	uri := noticeURI("s3cret", "bill", params, url.Values{"price": {"2"}})
+
+	// the clearing price of a bid in EUR passed off as JPY
+	ctx := newTestRequestCtx(strings.Replace(uri, "cur=EUR", "cur=JPY", 1), nil)
+	h.Bill(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("Bill() with a tampered currency return %d", ctx.Response.StatusCode())
+	}
+
+	ctx = newTestRequestCtx(uri, nil)
+	h.Bill(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("Bill() return %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	spend, err := h.Pacer.Spend(context.Background(), h.Campaigns.Campaign("c1"), time.Now())
+	if err != nil || spend.TotalSpend != 0.0025 {
+		t.Errorf("Spend() of a bill of 2 EUR CPM return %+v, %+v", spend, err)
+	}
+}
+
+func TestNoticeHandlerTrackers(t *testing.T) {
+	h := newTestNoticeHandler(t, NewMemoryBidStore())
+
+	x, err := newCampaignIndex([]*Campaign{{
+		ID:        "c1",
+		Creatives: []*Creative{{ID: "cr1", Format: "banner", W: 300, H: 250, Template: "x", ClickURL: "https://example.com/landing"}},
+		LineItems: []*LineItem{{ID: "li1", Creatives: []string{"cr1"}}},
+	}})
+	if err != nil {
+		t.Fatalf("newCampaignIndex() error: %+v", err)
+	}
+	h.Campaigns.index.Store(x)
+
+	params := url.Values{"x": {"x1"}, "bid": {"b1"}, "cid": {"c1"}, "li": {"li1"}, "crid": {"cr1"}}
+
+	cases := []struct {
+		Handler    fasthttp.RequestHandler
+		URI        string
+		StatusCode int
+	}{
+		{h.Imp, noticeURI("s3cret", "imp", params, url.Values{"id": {"a1"}}), fasthttp.StatusOK},
+		{h.Imp, "/imp?x=x1&bid=b1&cid=c1&li=li1&crid=cr1&id=a1", fasthttp.StatusBadRequest},
+		{h.Imp, noticeURI("s3cret", "click", params, url.Values{"id": {"a1"}}), fasthttp.StatusBadRequest},
+		{h.Click, noticeURI("s3cret", "click", params, url.Values{"id": {"a1"}}), fasthttp.StatusFound},
+		{h.Click, "/click?x=x1&bid=b1&cid=c1&li=li1&crid=cr1&id=a1", fasthttp.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		ctx := newTestRequestCtx(c.URI, nil)
+		c.Handler(ctx)
+		if ctx.Response.StatusCode() != c.StatusCode {
+			t.Errorf("tracker %s return %d, not match %d", c.URI, ctx.Response.StatusCode(), c.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// AuctionCandidate is a line item eligible for an impression.
+type AuctionCandidate struct {
+	LineItem *LineItem
+	Creative *Creative
+	Deal     *Deal
+	// Floor is the floor of the impression or deal in USD.
+	Floor float64
+}
+
+// Auction returns the winner among candidates, the one of the highest eCPM
+// in the highest priority tier, ties are broken at random. It returns nil
+// for no candidates.
+func Auction(candidates []*AuctionCandidate) *AuctionCandidate {
+	var winner *AuctionCandidate
+	ties := 0
+	for _, c := range candidates {
+		if winner == nil {
+			winner, ties = c, 1
+			continue
+		}
+
+		li, w := c.LineItem, winner.LineItem
+		switch {
+		case li.Priority > w.Priority, li.Priority == w.Priority && li.ECPM() > w.ECPM():
+			winner, ties = c, 1
+		case li.Priority == w.Priority && li.ECPM() == w.ECPM():
+			// reservoir sampling of the tied candidates
+			ties++
+			if rand.Intn(ties) == 0 {
+				winner = c
+			}
+		}
+	}
+	return winner
+}
+
+// ShadePrice lowers price towards floor by the ratio of target to the recent
+// win rate of the placement when it wins more often than target, keeping at
+// least minFactor of price. A negative rate means no data and no shading.
+func ShadePrice(price, floor, rate, target, minFactor float64) float64 {
+	if rate <= target || rate < 0 || target <= 0 {
+		return price
+	}
+
+	factor := target / rate
+	if factor < minFactor {
+		factor = minFactor
+	}
+
+	shaded := price * factor
+	if shaded < floor {
+		shaded = floor
+	}
+
+	return shaded
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAuction(t *testing.T) {
+	cases := []struct {
+		Items  []*LineItem
+		Winner string
+	}{
+		{nil, ""},
+		{[]*LineItem{{ID: "a", Price: 1}, {ID: "b", Price: 2}}, "b"},
+		{[]*LineItem{{ID: "a", Price: 1, Priority: 1}, {ID: "b", Price: 2}}, "a"},
+		{[]*LineItem{{ID: "a", Price: 1.5}, {ID: "b", Price: 0.5, Model: "cpc", CTR: 0.004}}, "b"},
+	}
+
+	for _, c := range cases {
+		var candidates []*AuctionCandidate
+		for _, li := range c.Items {
+			candidates = append(candidates, &AuctionCandidate{LineItem: li})
+		}
+
+		winner := ""
+		if w := Auction(candidates); w != nil {
+			winner = w.LineItem.ID
+		}
+		if winner != c.Winner {
+			t.Errorf("Auction(%d candidates) return %#v, not match %#v", len(candidates), winner, c.Winner)
+		}
+	}
+}
+
+func TestAuctionTieBreak(t *testing.T) {
+	candidates := []*AuctionCandidate{
+		{LineItem: &LineItem{ID: "a", Price: 2}},
+		{LineItem: &LineItem{ID: "b", Price: 2}},
+		{LineItem: &LineItem{ID: "c", Price: 1, Model: "cpc", CTR: 0.002}},
+		{LineItem: &LineItem{ID: "d", Price: 1}},
+	}
+
+	wins := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		wins[Auction(candidates).LineItem.ID]++
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if wins[id] < 500 {
+			t.Errorf("Auction() tied candidate %#v wins %d of 3000", id, wins[id])
+		}
+	}
+	if wins["d"] != 0 {
+		t.Errorf("Auction() lower candidate %#v wins %d of 3000", "d", wins["d"])
+	}
+}
+
+func TestShadePrice(t *testing.T) {
+	cases := []struct {
+		Price  float64
+		Floor  float64
+		Rate   float64
+		Shaded float64
+	}{
+		{2, 0, -1, 2},
+		{2, 0, 0.2, 2},
+		{2, 0, 0.5, 1.5},
+		{2, 0, 0.6, 1.5},
+		{2, 1.8, 0.5, 1.8},
+		{4, 0, 0.4, 3},
+	}
+
+	for _, c := range cases {
+		shaded := ShadePrice(c.Price, c.Floor, c.Rate, 0.3, 0.75)
+		if shaded < c.Shaded-1e-9 || shaded > c.Shaded+1e-9 {
+			t.Errorf("ShadePrice(%#v, %#v, %#v) return %#v, not match %#v", c.Price, c.Floor, c.Rate, shaded, c.Shaded)
+		}
+	}
+}
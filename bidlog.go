@@ -0,0 +1,217 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// BidLogRecord is a line of the bid log, a bid request with our decision and
+// response, or a notice of a bid.
+type BidLogRecord struct {
+	Time      time.Time    `json:"time"`
+	Type      string       `json:"type"`
+	Exchange  string       `json:"exchange,omitempty"`
+	RequestID string       `json:"request_id"`
+	Decision  string       `json:"decision,omitempty"`
+	Request   *BidRequest  `json:"request,omitempty"`
+	Response  *BidResponse `json:"response,omitempty"`
+	BidID     string       `json:"bid_id,omitempty"`
+	Campaign  string       `json:"campaign_id,omitempty"`
+	LineItem  string       `json:"line_item_id,omitempty"`
+	Creative  string       `json:"creative_id,omitempty"`
+	Price     float64      `json:"price,omitempty"`
+	Loss      int          `json:"loss_reason,omitempty"`
+}
+
+// BidLogger writes records to gzipped newline-delimited json files in Dir,
+// in the background. Files are named by their open time and a sequence
+// number. A file is rotated after MaxSize compressed bytes, MaxAge or a write
+// error, and is renamed from its ".tmp" name when complete. Records of a
+// request id are sampled together by the rate of their exchange in Sampling,
+// 1 by default. Log never blocks, records are dropped when the queue of
+// QueueSize is full. A nil BidLogger discards all records.
+type BidLogger struct {
+	Dir       string
+	MaxSize   int64
+	MaxAge    time.Duration
+	QueueSize int
+	Sampling  map[string]float64
+
+	queue   chan *BidLogRecord
+	closing chan struct{}
+	closed  chan struct{}
+	written int64
+	dropped int64
+
+	file   *os.File
+	gz     *gzip.Writer
+	size   int64
+	opened time.Time
+	seq    int
+}
+
+// Start starts the writer of l.
+func (l *BidLogger) Start() error {
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+
+	l.queue = make(chan *BidLogRecord, l.QueueSize)
+	l.closing = make(chan struct{})
+	l.closed = make(chan struct{})
+
+	go l.run()
+
+	return nil
+}
+
+// Log queues r if it is sampled.
+func (l *BidLogger) Log(r *BidLogRecord) {
+	if l == nil || !l.sampled(r) {
+		return
+	}
+
+	select {
+	case l.queue <- r:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+func (l *BidLogger) sampled(r *BidLogRecord) bool {
+	rate, ok := l.Sampling[r.Exchange]
+	if !ok || rate >= 1 {
+		return true
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(r.RequestID))
+
+	return float64(h.Sum32()%10000) < rate*10000
+}
+
+// Written returns the count of records written.
+func (l *BidLogger) Written() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.written)
+}
+
+// Dropped returns the count of records dropped for a full queue or write
+// errors.
+func (l *BidLogger) Dropped() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.dropped)
+}
+
+// Close writes the queued records and closes the current file.
+func (l *BidLogger) Close() {
+	if l == nil {
+		return
+	}
+	close(l.closing)
+	<-l.closed
+}
+
+func (l *BidLogger) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case r := <-l.queue:
+			l.write(r)
+		case <-ticker.C:
+			if l.file != nil && time.Since(l.opened) >= l.MaxAge {
+				l.rotate()
+			}
+		case <-l.closing:
+			for {
+				select {
+				case r := <-l.queue:
+					l.write(r)
+				default:
+					l.rotate()
+					close(l.closed)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *BidLogger) write(r *BidLogRecord) {
+	if l.file == nil {
+		l.opened = time.Now()
+		l.seq++
+		name := filepath.Join(l.Dir, fmt.Sprintf("bids-%s-%06d.ndjson.gz.tmp", l.opened.UTC().Format("20060102T150405.000000000"), l.seq))
+
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			glog.Errors().Err(err).Str("filename", name).Msg("open bid log error")
+			atomic.AddInt64(&l.dropped, 1)
+			return
+		}
+
+		l.file, l.size = file, 0
+		l.gz = gzip.NewWriter(&countingWriter{w: file, n: &l.size})
+	}
+
+	if err := json.NewEncoder(l.gz).Encode(r); err != nil {
+		glog.Errors().Err(err).Str("filename", l.file.Name()).Msg("write bid log error")
+		atomic.AddInt64(&l.dropped, 1)
+		// the gzip writer fails all later writes, continue in a new file.
+		l.rotate()
+		return
+	}
+	atomic.AddInt64(&l.written, 1)
+
+	if l.size >= l.MaxSize {
+		l.rotate()
+	}
+}
+
+// rotate completes the current file.
+func (l *BidLogger) rotate() {
+	if l.file == nil {
+		return
+	}
+
+	name := l.file.Name()
+	err := l.gz.Close()
+	if err == nil {
+		err = l.file.Close()
+	} else {
+		l.file.Close()
+	}
+	if err == nil {
+		err = os.Rename(name, name[:len(name)-len(".tmp")])
+	}
+	if err != nil {
+		glog.Errors().Err(err).Str("filename", name).Msg("close bid log error")
+	}
+
+	l.file, l.gz = nil, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	*w.n += int64(n)
+	return n, err
+}
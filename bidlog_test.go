@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBidLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bidlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &BidLogger{
+		Dir:       dir,
+		MaxSize:   1,
+		MaxAge:    time.Minute,
+		QueueSize: 100,
+		Sampling:  map[string]float64{"x1": 0},
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("Start() error: %+v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		l.Log(&BidLogRecord{Time: time.Now(), Type: "bid", RequestID: strconv.Itoa(i), Decision: "no_bid"})
+		// sampled out
+		l.Log(&BidLogRecord{Time: time.Now(), Type: "bid", Exchange: "x1", RequestID: strconv.Itoa(i)})
+	}
+	l.Close()
+
+	if l.Written() != 3 || l.Dropped() != 0 {
+		t.Errorf("BidLogger written %d dropped %d, not match 3 and 0", l.Written(), l.Dropped())
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	lines := 0
+	for _, name := range files {
+		if filepath.Ext(name) != ".gz" {
+			t.Errorf("BidLogger left incomplete file %s", name)
+			continue
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip.NewReader(%s) error: %+v", name, err)
+		}
+		for s := bufio.NewScanner(gz); s.Scan(); lines++ {
+			var r BidLogRecord
+			if err := json.Unmarshal(s.Bytes(), &r); err != nil || r.Decision != "no_bid" {
+				t.Errorf("BidLogger wrote %s, not a record", s.Text())
+			}
+		}
+		f.Close()
+	}
+
+	if lines != 3 || len(files) != 3 {
+		t.Errorf("BidLogger wrote %d lines in %d files, not match 3", lines, len(files))
+	}
+}
+
+func TestBidLoggerWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bidlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &BidLogger{Dir: dir, MaxSize: 100 << 20, MaxAge: time.Minute}
+
+	l.write(&BidLogRecord{Time: time.Now(), Type: "bid", RequestID: "1"})
+	if l.file == nil || !strings.HasSuffix(l.file.Name(), "-000001.ndjson.gz.tmp") {
+		t.Fatalf("write() should open the file of sequence 1")
+	}
+
+	// fail the writes of the gzip writer with a record larger than its buffer
+	l.file.Close()
+	l.write(&BidLogRecord{Time: time.Now(), Type: "bid", RequestID: RandomHex(1 << 20)})
+	if l.Dropped() != 1 || l.file != nil {
+		t.Fatalf("write() error should drop the record and rotate, dropped %d", l.Dropped())
+	}
+
+	l.write(&BidLogRecord{Time: time.Now(), Type: "bid", RequestID: "3"})
+	if l.Written() != 2 || l.file == nil || !strings.HasSuffix(l.file.Name(), "-000002.ndjson.gz.tmp") {
+		t.Errorf("write() after an error should continue in the file of sequence 2, written %d", l.Written())
+	}
+	l.rotate()
+}
+
+func TestBidLoggerSampled(t *testing.T) {
+	l := &BidLogger{Sampling: map[string]float64{"x1": 0.25}}
+
+	n := 0
+	for i := 0; i < 10000; i++ {
+		r := &BidLogRecord{Exchange: "x1", RequestID: strconv.Itoa(i)}
+		if l.sampled(r) {
+			n++
+		}
+		if l.sampled(r) != l.sampled(&BidLogRecord{Exchange: "x1", RequestID: r.RequestID, Type: "win"}) {
+			t.Fatalf("sampled(%#v) should be stable by request id", r.RequestID)
+		}
+	}
+
+	if n < 2000 || n > 3000 {
+		t.Errorf("sampled() kept %d of 10000 records, not near 2500", n)
+	}
+}
+
+// readBidLog returns the records of the completed files in dir.
+func readBidLog(t *testing.T, dir string) []BidLogRecord {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.gz"))
+
+	var records []BidLogRecord
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip.NewReader(%s) error: %+v", name, err)
+		}
+		for s := bufio.NewScanner(gz); s.Scan(); {
+			var r BidLogRecord
+			if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+				t.Errorf("BidLogger wrote %s, not a record", s.Text())
+			}
+			records = append(records, r)
+		}
+		f.Close()
+	}
+
+	return records
+}
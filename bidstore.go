@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aerospike/aerospike-client-go"
+	"github.com/aerospike/aerospike-client-go/types"
+	"github.com/phuslu/glog"
+)
+
+// BidStore is the key-value storage of bidding. A record is addressed by set
+// and key and holds named bins, like an aerospike record. Get of a missing
+// record returns a nil map and no error, a write with ttl <= 0 never expires.
+type BidStore interface {
+	Get(ctx context.Context, set, key string) (map[string]interface{}, error)
+	Put(ctx context.Context, set, key string, bins map[string]interface{}, ttl time.Duration) error
+	Incr(ctx context.Context, set, key, bin string, delta int64, ttl time.Duration) (int64, error)
+	Health() BidStoreHealth
+}
+
+// BidStoreHealth is served by the public /health, so Error only tells that
+// the last connect failed, the cause is logged.
+type BidStoreHealth struct {
+	Backend   string `json:"backend"`
+	Connected bool   `json:"connected"`
+	Nodes     int    `json:"nodes"`
+	Error     bool   `json:"error,omitempty"`
+}
+
+var ErrBidStoreUnavailable = errors.New("bid store is unavailable")
+
+// aerospikeClient is the part of *aerospike.Client used by AerospikeBidStore.
+type aerospikeClient interface {
+	IsConnected() bool
+	GetNodes() []*aerospike.Node
+	Close()
+	Get(policy *aerospike.BasePolicy, key *aerospike.Key, binNames ...string) (*aerospike.Record, error)
+	Put(policy *aerospike.WritePolicy, key *aerospike.Key, binMap aerospike.BinMap) error
+	Operate(policy *aerospike.WritePolicy, key *aerospike.Key, operations ...*aerospike.Operation) (*aerospike.Record, error)
+}
+
+func dialAerospike(host string, port int) (aerospikeClient, error) {
+	policy := aerospike.NewClientPolicy()
+	policy.Timeout = 5 * time.Second
+
+	client, err := aerospike.NewClientWithPolicy(policy, host, port)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+const (
+	aerospikeMinBackoff = 1 * time.Second
+	aerospikeMaxBackoff = 1 * time.Minute
+)
+
+// AerospikeBidStore connects to the aerospike cluster of the [bid] config in
+// background, see Watcher. All operations fail with ErrBidStoreUnavailable
+// until it is connected.
+type AerospikeBidStore struct {
+	Config *Config
+
+	mu     sync.RWMutex
+	client aerospikeClient
+	host   string
+	port   int
+	err    error
+
+	// dial is dialAerospike if nil, tests replace it.
+	dial func(host string, port int) (aerospikeClient, error)
+}
+
+// Watcher connects to aerospike with exponential backoff, and reconnects
+// when the host or port of the [bid] config changes.
+func (s *AerospikeBidStore) Watcher() {
+	backoff := aerospikeMinBackoff
+	for {
+		time.Sleep(s.connect(&backoff))
+	}
+}
+
+// connect dials aerospike unless it is connected to the configured host and
+// port, and returns how long Watcher waits before the next check. backoff is
+// doubled on failure and reset on success.
+func (s *AerospikeBidStore) connect(backoff *time.Duration) time.Duration {
+	host, port := s.Config.Bid.AerospikeHost, s.Config.Bid.AerospikePort
+
+	s.mu.RLock()
+	connected := s.client != nil && s.host == host && s.port == port
+	s.mu.RUnlock()
+
+	if connected {
+		return 5 * time.Second
+	}
+
+	dial := s.dial
+	if dial == nil {
+		dial = dialAerospike
+	}
+
+	client, err := dial(host, port)
+	if err != nil {
+		glog.Errors().Err(err).Str("aerospike_host", host).Int("aerospike_port", port).Msg("aerospike.NewClient(..) error")
+
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+
+		wait := *backoff + time.Duration(rand.Int63n(int64(*backoff/2)))
+		if *backoff *= 2; *backoff > aerospikeMaxBackoff {
+			*backoff = aerospikeMaxBackoff
+		}
+		return wait
+	}
+
+	glog.Infos().Str("aerospike_host", host).Int("aerospike_port", port).Int("nodes", len(client.GetNodes())).Msg("aerospike connected")
+
+	s.mu.Lock()
+	old := s.client
+	s.client, s.host, s.port, s.err = client, host, port, nil
+	s.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	*backoff = aerospikeMinBackoff
+	return 0
+}
+
+func (s *AerospikeBidStore) Health() BidStoreHealth {
+	s.mu.RLock()
+	client, err := s.client, s.err
+	s.mu.RUnlock()
+
+	health := BidStoreHealth{
+		Backend: "aerospike",
+		Error:   err != nil,
+	}
+	if client != nil {
+		health.Connected = client.IsConnected()
+		health.Nodes = len(client.GetNodes())
+	}
+
+	return health
+}
+
+func (s *AerospikeBidStore) getClient() (aerospikeClient, error) {
+	s.mu.RLock()
+	client := s.client
+	s.mu.RUnlock()
+
+	if client == nil || !client.IsConnected() {
+		return nil, ErrBidStoreUnavailable
+	}
+
+	return client, nil
+}
+
+func (s *AerospikeBidStore) Get(ctx context.Context, set, key string) (map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := aerospike.NewKey(s.Config.Bid.AerospikeNamespace, set, key)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := aerospike.NewPolicy()
+	if deadline, ok := ctx.Deadline(); ok {
+		policy.TotalTimeout = time.Until(deadline)
+	}
+
+	rec, err := client.Get(policy, k)
+	if err != nil {
+		if aerr, ok := err.(types.AerospikeError); ok && aerr.ResultCode() == types.KEY_NOT_FOUND_ERROR {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if rec == nil {
+		return nil, nil
+	}
+
+	return rec.Bins, nil
+}
+
+func (s *AerospikeBidStore) Put(ctx context.Context, set, key string, bins map[string]interface{}, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	k, err := aerospike.NewKey(s.Config.Bid.AerospikeNamespace, set, key)
+	if err != nil {
+		return err
+	}
+
+	return client.Put(s.writePolicy(ctx, ttl), k, aerospike.BinMap(bins))
+}
+
+func (s *AerospikeBidStore) Incr(ctx context.Context, set, key, bin string, delta int64, ttl time.Duration) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	client, err := s.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	k, err := aerospike.NewKey(s.Config.Bid.AerospikeNamespace, set, key)
+	if err != nil {
+		return 0, err
+	}
+
+	rec, err := client.Operate(s.writePolicy(ctx, ttl), k, aerospike.AddOp(aerospike.NewBin(bin, delta)), aerospike.GetOpForBin(bin))
+	if err != nil {
+		return 0, err
+	}
+
+	return ToInt64(rec.Bins[bin]), nil
+}
+
+func (s *AerospikeBidStore) writePolicy(ctx context.Context, ttl time.Duration) *aerospike.WritePolicy {
+	// an expiration of 0 is the namespace default ttl, not never.
+	expiration := uint32(aerospike.TTLDontExpire)
+	if ttl > 0 {
+		expiration = uint32(ttl / time.Second)
+	}
+	policy := aerospike.NewWritePolicy(0, expiration)
+	if deadline, ok := ctx.Deadline(); ok {
+		policy.TotalTimeout = time.Until(deadline)
+	}
+	return policy
+}
+
+// MemoryBidStore keeps records in process memory, it is meant for tests and
+// local development. Expired records are purged by writes, at most once per
+// memoryPurgeInterval.
+type MemoryBidStore struct {
+	mu     sync.Mutex
+	m      map[string]*memoryRecord
+	purged time.Time
+}
+
+const memoryPurgeInterval = time.Minute
+
+type memoryRecord struct {
+	bins    map[string]interface{}
+	expires time.Time
+}
+
+func NewMemoryBidStore() *MemoryBidStore {
+	return &MemoryBidStore{
+		m: make(map[string]*memoryRecord),
+	}
+}
+
+func (s *MemoryBidStore) Get(ctx context.Context, set, key string) (map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := s.get(set + "/" + key)
+	if rec == nil {
+		return nil, nil
+	}
+
+	bins := make(map[string]interface{}, len(rec.bins))
+	for k, v := range rec.bins {
+		bins[k] = v
+	}
+
+	return bins, nil
+}
+
+func (s *MemoryBidStore) Put(ctx context.Context, set, key string, bins map[string]interface{}, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(time.Now())
+
+	rec := s.get(set + "/" + key)
+	if rec == nil {
+		rec = &memoryRecord{bins: make(map[string]interface{}, len(bins))}
+		s.m[set+"/"+key] = rec
+	}
+
+	for k, v := range bins {
+		rec.bins[k] = v
+	}
+	rec.touch(ttl)
+
+	return nil
+}
+
+func (s *MemoryBidStore) Incr(ctx context.Context, set, key, bin string, delta int64, ttl time.Duration) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(time.Now())
+
+	rec := s.get(set + "/" + key)
+	if rec == nil {
+		rec = &memoryRecord{bins: make(map[string]interface{})}
+		s.m[set+"/"+key] = rec
+	}
+
+	n := ToInt64(rec.bins[bin]) + delta
+	rec.bins[bin] = n
+	rec.touch(ttl)
+
+	return n, nil
+}
+
+func (s *MemoryBidStore) Health() BidStoreHealth {
+	return BidStoreHealth{
+		Backend:   "memory",
+		Connected: true,
+	}
+}
+
+func (s *MemoryBidStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.m)
+}
+
+func (s *MemoryBidStore) get(k string) *memoryRecord {
+	rec, ok := s.m[k]
+	if !ok {
+		return nil
+	}
+	if !rec.expires.IsZero() && rec.expires.Before(time.Now()) {
+		delete(s.m, k)
+		return nil
+	}
+	return rec
+}
+
+// purge deletes all expired records if the last purge is older than
+// memoryPurgeInterval, s.mu must be held.
+func (s *MemoryBidStore) purge(now time.Time) {
+	if now.Sub(s.purged) < memoryPurgeInterval {
+		return
+	}
+	s.purged = now
+
+	for k, rec := range s.m {
+		if !rec.expires.IsZero() && rec.expires.Before(now) {
+			delete(s.m, k)
+		}
+	}
+}
+
+func (rec *memoryRecord) touch(ttl time.Duration) {
+	if ttl > 0 {
+		rec.expires = time.Now().Add(ttl)
+	} else {
+		rec.expires = time.Time{}
+	}
+}
+
+// ToInt64 converts an integer or float bin value to int64, aerospike returns
+// integer bins as int.
+func ToInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case string:
+		var n int64
+		fmt.Sscan(v, &n)
+		return n
+	default:
+		return 0
+	}
+}
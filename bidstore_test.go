@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aerospike/aerospike-client-go"
+)
+
+func TestMemoryBidStore(t *testing.T) {
+	s := NewMemoryBidStore()
+	ctx := context.Background()
+
+	if bins, err := s.Get(ctx, "profile", "u1"); err != nil || bins != nil {
+		t.Fatalf("Get() of a missing record return %+v, %+v", bins, err)
+	}
+
+	s.Put(ctx, "profile", "u1", map[string]interface{}{"a": "1"}, 0)
+	s.Put(ctx, "profile", "u1", map[string]interface{}{"b": 2}, 0)
+	if bins, _ := s.Get(ctx, "profile", "u1"); bins["a"] != "1" || bins["b"] != 2 {
+		t.Errorf("Get() return %+v", bins)
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		if n, _ := s.Incr(ctx, "freq", "u1", "n", 1, time.Minute); n != i {
+			t.Errorf("Incr() return %d, not match %d", n, i)
+		}
+	}
+
+	s.Incr(ctx, "freq", "u2", "n", 1, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if bins, _ := s.Get(ctx, "freq", "u2"); bins != nil {
+		t.Errorf("Get() of an expired record return %+v", bins)
+	}
+}
+
+func TestMemoryBidStorePurge(t *testing.T) {
+	s := NewMemoryBidStore()
+	ctx := context.Background()
+
+	for _, key := range []string{"u1", "u2", "u3"} {
+		s.Incr(ctx, "freq", key, "n", 1, time.Millisecond)
+	}
+	s.Incr(ctx, "freq", "u4", "n", 1, time.Minute)
+	time.Sleep(5 * time.Millisecond)
+
+	// within the purge interval the expired records are kept.
+	s.Put(ctx, "profile", "u5", map[string]interface{}{"a": "1"}, 0)
+	if n := s.Len(); n != 5 {
+		t.Errorf("Len() return %d, not match %d", n, 5)
+	}
+
+	s.mu.Lock()
+	s.purged = time.Now().Add(-memoryPurgeInterval)
+	s.mu.Unlock()
+
+	s.Put(ctx, "profile", "u6", map[string]interface{}{"a": "1"}, 0)
+	if n := s.Len(); n != 3 {
+		t.Errorf("Len() after purge return %d, not match %d", n, 3)
+	}
+}
+
+type fakeAerospikeClient struct {
+	connected bool
+	closed    bool
+}
+
+func (c *fakeAerospikeClient) IsConnected() bool           { return c.connected }
+func (c *fakeAerospikeClient) GetNodes() []*aerospike.Node { return make([]*aerospike.Node, 2) }
+func (c *fakeAerospikeClient) Close()                      { c.closed = true }
+
+func (c *fakeAerospikeClient) Get(policy *aerospike.BasePolicy, key *aerospike.Key, binNames ...string) (*aerospike.Record, error) {
+	return nil, nil
+}
+
+func (c *fakeAerospikeClient) Put(policy *aerospike.WritePolicy, key *aerospike.Key, binMap aerospike.BinMap) error {
+	return nil
+}
+
+func (c *fakeAerospikeClient) Operate(policy *aerospike.WritePolicy, key *aerospike.Key, operations ...*aerospike.Operation) (*aerospike.Record, error) {
+	return nil, nil
+}
+
+func TestAerospikeBidStoreConnect(t *testing.T) {
+	var dials []int
+	fail := 2
+	s := &AerospikeBidStore{Config: &Config{}}
+	s.Config.Bid.AerospikeHost = "127.0.0.1"
+	s.Config.Bid.AerospikePort = 3000
+	s.dial = func(host string, port int) (aerospikeClient, error) {
+		dials = append(dials, port)
+		if fail > 0 {
+			fail--
+			return nil, errors.New("connection refused by 127.0.0.1:3000")
+		}
+		return &fakeAerospikeClient{connected: true}, nil
+	}
+
+	if h := s.Health(); h.Connected || h.Error {
+		t.Errorf("Health() before connect return %+v", h)
+	}
+
+	backoff := aerospikeMinBackoff
+	for i, want := range []time.Duration{aerospikeMinBackoff, 2 * aerospikeMinBackoff} {
+		wait := s.connect(&backoff)
+		if wait < want || wait >= want+want/2 {
+			t.Errorf("connect() #%d wait %s, not in [%s, %s)", i, wait, want, want+want/2)
+		}
+		if backoff != 2*want {
+			t.Errorf("connect() #%d backoff %s, not match %s", i, backoff, 2*want)
+		}
+		if h := s.Health(); h.Connected || !h.Error {
+			t.Errorf("Health() after a failed connect return %+v", h)
+		}
+	}
+
+	if wait := s.connect(&backoff); wait != 0 || backoff != aerospikeMinBackoff {
+		t.Errorf("connect() return %s with backoff %s after success", wait, backoff)
+	}
+	if h := s.Health(); !h.Connected || h.Error || h.Nodes != 2 {
+		t.Errorf("Health() after connect return %+v", h)
+	}
+
+	// connected to the configured host and port, nothing to dial.
+	s.connect(&backoff)
+	if len(dials) != 3 {
+		t.Errorf("connect() dialed %d times, not match %d", len(dials), 3)
+	}
+
+	old := s.client.(*fakeAerospikeClient)
+	s.Config.Bid.AerospikePort = 3001
+	s.connect(&backoff)
+	if len(dials) != 4 || dials[3] != 3001 || !old.closed {
+		t.Errorf("connect() should reconnect to the new port and close the old client, dials %v", dials)
+	}
+
+	old = s.client.(*fakeAerospikeClient)
+	old.connected = false
+	if h := s.Health(); h.Connected {
+		t.Errorf("Health() of a disconnected client return %+v", h)
+	}
+	if _, err := s.Get(context.Background(), "profile", "u1"); err != ErrBidStoreUnavailable {
+		t.Errorf("Get() of a disconnected client return %+v", err)
+	}
+}
+
+func TestAerospikeBidStoreBackoff(t *testing.T) {
+	s := &AerospikeBidStore{Config: &Config{}}
+	s.dial = func(host string, port int) (aerospikeClient, error) {
+		return nil, errors.New("timeout")
+	}
+
+	backoff := aerospikeMinBackoff
+	for i := 0; i < 10; i++ {
+		if wait := s.connect(&backoff); wait >= aerospikeMaxBackoff+aerospikeMaxBackoff/2 {
+			t.Errorf("connect() #%d wait %s exceeds the max backoff", i, wait)
+		}
+	}
+	if backoff != aerospikeMaxBackoff {
+		t.Errorf("backoff is %s, not match %s", backoff, aerospikeMaxBackoff)
+	}
+}
+
+func TestAerospikeBidStoreWritePolicy(t *testing.T) {
+	s := &AerospikeBidStore{}
+
+	cases := []struct {
+		TTL        time.Duration
+		Expiration uint32
+	}{
+		{0, aerospike.TTLDontExpire},
+		{-time.Second, aerospike.TTLDontExpire},
+		{48 * time.Hour, 48 * 3600},
+	}
+
+	for _, c := range cases {
+		if got := s.writePolicy(context.Background(), c.TTL).Expiration; got != c.Expiration {
+			t.Errorf("writePolicy(%s) expiration %d, not match %d", c.TTL, got, c.Expiration)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &CircuitBreaker{
+		FailureThreshold: 2,
+		SlowThreshold:    time.Second,
+		OpenTimeout:      50 * time.Millisecond,
+	}
+
+	b.Done(errors.New("failure"), 0)
+	if s := b.State(); s != BreakerClosed {
+		t.Fatalf("State() return %s after 1 failure", s)
+	}
+
+	b.Done(nil, 2*time.Second)
+	if s := b.State(); s != BreakerOpen {
+		t.Fatalf("State() return %s after 1 failure and 1 slow call", s)
+	}
+	if b.Allow() {
+		t.Fatalf("Allow() should reject calls when open")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatalf("Allow() should let a probe through when half-open")
+	}
+	if b.Allow() {
+		t.Fatalf("Allow() should let only one probe through when half-open")
+	}
+
+	b.Done(nil, time.Millisecond)
+	if s := b.State(); s != BreakerClosed {
+		t.Fatalf("State() return %s after a successful probe", s)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+// BudgetPacer accounts the spend of campaigns in the "micros" bin of Set
+// records, keyed by campaign and UTC day or "total", so all apiserver
+// instances sharing Store pace together. Spend is cached locally for CacheTTL.
+// The "bid:" records of Set mark the counters a bid was added to.
+type BudgetPacer struct {
+	Store    BidStore
+	Set      string
+	Cache    lrucache.Cache
+	CacheTTL time.Duration
+}
+
+type CampaignSpend struct {
+	CampaignID  string  `json:"campaign_id"`
+	DailyBudget float64 `json:"daily_budget,omitempty"`
+	TotalBudget float64 `json:"total_budget,omitempty"`
+	DailySpend  float64 `json:"daily_spend"`
+	TotalSpend  float64 `json:"total_spend"`
+	Pacing      float64 `json:"pacing"`
+}
+
+func dailySpendKey(campaignID string, now time.Time) string {
+	return campaignID + ":" + now.UTC().Format("20060102")
+}
+
+func (p *BudgetPacer) spend(ctx context.Context, key string) (float64, error) {
+	if v, ok := p.Cache.GetNotStale(key); ok {
+		return v.(float64), nil
+	}
+
+	bins, err := p.Store.Get(ctx, p.Set, key)
+	if err != nil {
+		return 0, err
+	}
+
+	spend := float64(ToInt64(bins["micros"])) / 1e6
+	p.Cache.Set(key, spend, time.Now().Add(p.CacheTTL))
+
+	return spend, nil
+}
+
+// Spend returns the spend and the bid probability of c, see Pacing.
+func (p *BudgetPacer) Spend(ctx context.Context, c *Campaign, now time.Time) (*CampaignSpend, error) {
+	s := &CampaignSpend{
+		CampaignID:  c.ID,
+		DailyBudget: c.DailyBudget,
+		TotalBudget: c.TotalBudget,
+	}
+
+	var err error
+	if s.DailySpend, err = p.spend(ctx, dailySpendKey(c.ID, now)); err != nil {
+		return nil, err
+	}
+	if s.TotalSpend, err = p.spend(ctx, c.ID+":total"); err != nil {
+		return nil, err
+	}
+
+	s.Pacing = Pacing(s.DailyBudget, s.DailySpend, now)
+	if s.TotalBudget > 0 && s.TotalSpend >= s.TotalBudget {
+		s.Pacing = 0
+	}
+
+	return s, nil
+}
+
+// Allow draws whether c bids now, by the probability of its pacing.
+func (p *BudgetPacer) Allow(ctx context.Context, c *Campaign, now time.Time) (bool, error) {
+	if c.DailyBudget <= 0 && c.TotalBudget <= 0 {
+		return true, nil
+	}
+
+	s, err := p.Spend(ctx, c, now)
+	if err != nil {
+		return false, err
+	}
+
+	return s.Pacing >= 1 || rand.Float64() < s.Pacing, nil
+}
+
+// Record accounts an impression of c won at price CPM by a bid. Each counter
+// is added once per bid, a marker is claimed before the add and released if
+// it fails, so the retry of a partially recorded bid only adds what is left.
+func (p *BudgetPacer) Record(ctx context.Context, c *Campaign, bidID string, price float64, now time.Time) error {
+	micros := int64(price * 1e6 / 1000)
+
+	for _, key := range []string{dailySpendKey(c.ID, now), c.ID + ":total"} {
+		ttl := time.Duration(0)
+		if key != c.ID+":total" {
+			ttl = 48 * time.Hour
+		}
+
+		marker := "bid:" + bidID + ":" + key
+		claimed, err := p.Store.Incr(ctx, p.Set, marker, "n", 1, 48*time.Hour)
+		if err != nil {
+			return err
+		}
+		if claimed > 1 {
+			continue
+		}
+
+		n, err := p.Store.Incr(ctx, p.Set, key, "micros", micros, ttl)
+		if err != nil {
+			p.Store.Incr(ctx, p.Set, marker, "n", -1, 48*time.Hour)
+			return err
+		}
+
+		p.Cache.Set(key, float64(n)/1e6, time.Now().Add(p.CacheTTL))
+	}
+
+	return nil
+}
+
+// Pacing returns the probability to bid for a daily budget, which spreads
+// the budget evenly over the UTC day. It is 1 while spend is behind the
+// elapsed fraction of the budget, and decreases linearly to 0 as spend runs
+// ahead towards the whole budget.
+func Pacing(budget, spend float64, now time.Time) float64 {
+	if budget <= 0 {
+		return 1
+	}
+	if spend >= budget {
+		return 0
+	}
+
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	target := budget * float64(now.Sub(midnight)) / float64(24*time.Hour)
+
+	if spend <= target {
+		return 1
+	}
+
+	return (budget - spend) / (budget - target)
+}
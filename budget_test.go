@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+func TestPacing(t *testing.T) {
+	noon := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		Budget float64
+		Spend  float64
+		Now    time.Time
+		Pacing float64
+	}{
+		{0, 100, noon, 1},
+		{100, 0, noon, 1},
+		{100, 50, noon, 1},
+		{100, 75, noon, 0.5},
+		{100, 100, noon, 0},
+		{100, 1, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), 0.99},
+	}
+
+	for _, c := range cases {
+		pacing := Pacing(c.Budget, c.Spend, c.Now)
+		if pacing < c.Pacing-1e-9 || pacing > c.Pacing+1e-9 {
+			t.Errorf("Pacing(%#v, %#v, %v) return %#v, not match %#v", c.Budget, c.Spend, c.Now, pacing, c.Pacing)
+		}
+	}
+}
+
+func TestBudgetPacer(t *testing.T) {
+	p := &BudgetPacer{
+		Store:    NewMemoryBidStore(),
+		Set:      "spend",
+		Cache:    lrucache.NewLRUCache(100),
+		CacheTTL: time.Second,
+	}
+
+	c := &Campaign{ID: "c1", DailyBudget: 10, TotalBudget: 12}
+
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 4; i++ {
+		if err := p.Record(ctx, c, "b"+strconv.Itoa(i), 2500, now); err != nil {
+			t.Fatalf("Record() error: %+v", err)
+		}
+	}
+
+	s, err := p.Spend(ctx, c, now)
+	if err != nil {
+		t.Fatalf("Spend() error: %+v", err)
+	}
+	if s.DailySpend != 10 || s.TotalSpend != 10 || s.Pacing != 0 {
+		t.Errorf("Spend() return %#v, daily budget should be exhausted", s)
+	}
+
+	s, _ = p.Spend(ctx, c, now.Add(2*time.Hour))
+	if s.DailySpend != 0 || s.TotalSpend != 10 || s.Pacing != 1 {
+		t.Errorf("Spend() return %#v, next day should be open", s)
+	}
+
+	p.Record(ctx, c, "b4", 2000, now.Add(2*time.Hour))
+	if ok, _ := p.Allow(ctx, c, now.Add(2*time.Hour)); ok {
+		t.Errorf("Allow() should stop at the total budget")
+	}
+}
+
+func TestBudgetPacerRecordOnce(t *testing.T) {
+	store := &failingBidStore{BidStore: NewMemoryBidStore(), set: "spend", key: "c1:total", fails: 1}
+	p := &BudgetPacer{
+		Store:    store,
+		Set:      "spend",
+		Cache:    lrucache.NewLRUCache(100),
+		CacheTTL: time.Second,
+	}
+
+	c := &Campaign{ID: "c1"}
+
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// the total fails after the daily spend is added, the retry and a
+	// duplicate of the bid only add the total.
+	if err := p.Record(ctx, c, "b1", 1000, now); err == nil {
+		t.Fatalf("Record() should fail with the store")
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.Record(ctx, c, "b1", 1000, now); err != nil {
+			t.Fatalf("Record() error: %+v", err)
+		}
+	}
+
+	s, err := p.Spend(ctx, c, now)
+	if err != nil {
+		t.Fatalf("Spend() error: %+v", err)
+	}
+	if s.DailySpend != 1 || s.TotalSpend != 1 {
+		t.Errorf("Spend() return %#v, should count the bid once", s)
+	}
+}
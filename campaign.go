@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/phuslu/glog"
+)
+
+// Campaign groups line items of an advertiser, budgets are in USD and zero
+// means unlimited.
+type Campaign struct {
+	ID            string         `json:"id"`
+	Name          string         `json:"name"`
+	Advertiser    string         `json:"advertiser"`
+	ADomain       []string       `json:"adomain"`
+	FrequencyCaps []FrequencyCap `json:"frequency_caps,omitempty"`
+	DailyBudget   float64        `json:"daily_budget,omitempty"`
+	TotalBudget   float64        `json:"total_budget,omitempty"`
+	Creatives     []*Creative    `json:"creatives,omitempty"`
+	LineItems     []*LineItem    `json:"line_items"`
+}
+
+// LineItem is a bidding unit of a campaign. Price is in USD per thousand
+// impressions for the "cpm" Model, or per click for "cpc" where CTR is the
+// expected click rate. Line items of a higher Priority win the internal
+// auction before any of a lower one. Creatives are the ids of the creatives
+// of the campaign it serves.
+type LineItem struct {
+	ID        string    `json:"id"`
+	Price     float64   `json:"price"`
+	Model     string    `json:"model,omitempty"`
+	CTR       float64   `json:"ctr,omitempty"`
+	Priority  int       `json:"priority,omitempty"`
+	Creatives []string  `json:"creatives,omitempty"`
+	Targeting Targeting `json:"targeting"`
+
+	Campaign *Campaign `json:"-"`
+
+	creatives []*Creative
+
+	location *time.Location
+	index    int
+}
+
+// ECPM returns the effective CPM of li in USD.
+func (li *LineItem) ECPM() float64 {
+	if li.Model == "cpc" {
+		return li.Price * li.CTR * 1000
+	}
+	return li.Price
+}
+
+// Creative returns the first creative of li which fits imp of req, or nil.
+func (li *LineItem) Creative(req *BidRequest, imp *Imp) *Creative {
+	for _, cr := range li.creatives {
+		if cr.Fits(li.Campaign, req, imp) {
+			return cr
+		}
+	}
+	return nil
+}
+
+// Targeting restricts where a line item bids, an empty field matches all.
+// Countries are ISO-3166-1 alpha-2 codes and Regions are ISO-3166-2 codes
+// like "US-CA". Segments match if the user is in any of them, Hours are the
+// hours of day in Timezone, UTC by default. A line item with Deals only bids
+// in those deals of the impression.
+type Targeting struct {
+	Countries   []string `json:"countries,omitempty"`
+	Regions     []string `json:"regions,omitempty"`
+	DeviceTypes []int    `json:"device_types,omitempty"`
+	OS          []string `json:"os,omitempty"`
+	Domains     []string `json:"domains,omitempty"`
+	Bundles     []string `json:"bundles,omitempty"`
+	Sizes       []string `json:"sizes,omitempty"`
+	Segments    []string `json:"segments,omitempty"`
+	Hours       []int    `json:"hours,omitempty"`
+	Timezone    string   `json:"timezone,omitempty"`
+	Deals       []string `json:"deals,omitempty"`
+}
+
+// bitset is a set of line item indexes.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitset) and(o bitset) {
+	for i := range b {
+		b[i] &= o[i]
+	}
+}
+
+func (b bitset) or(o bitset) {
+	for i := range b {
+		b[i] |= o[i]
+	}
+}
+
+func (b bitset) each(f func(i int)) {
+	for i, w := range b {
+		for w != 0 {
+			j := bits.TrailingZeros64(w)
+			f(i*64 + j)
+			w &^= 1 << uint(j)
+		}
+	}
+}
+
+// targetingIndex maps the values of a targeting dimension to the line items
+// targeting them, line items not targeting the dimension are in any.
+type targetingIndex struct {
+	values map[string]bitset
+	any    bitset
+}
+
+func newTargetingIndex(n int) *targetingIndex {
+	return &targetingIndex{
+		values: make(map[string]bitset),
+		any:    newBitset(n),
+	}
+}
+
+func (x *targetingIndex) add(i, n int, values []string) {
+	if len(values) == 0 {
+		x.any.set(i)
+		return
+	}
+	for _, v := range values {
+		b, ok := x.values[v]
+		if !ok {
+			b = newBitset(n)
+			x.values[v] = b
+		}
+		b.set(i)
+	}
+}
+
+// filter keeps the line items of candidates which target any of values or
+// do not target the dimension.
+func (x *targetingIndex) filter(candidates bitset, values ...string) {
+	matched := newBitset(len(candidates) * 64)
+	matched.or(x.any)
+	for _, v := range values {
+		if b, ok := x.values[v]; ok {
+			matched.or(b)
+		}
+	}
+	candidates.and(matched)
+}
+
+type campaignIndex struct {
+	campaigns []*Campaign
+	lineItems []*LineItem
+	byID      map[string]*Campaign
+	creatives map[string]*Creative
+
+	countries   *targetingIndex
+	regions     *targetingIndex
+	deviceTypes *targetingIndex
+	os          *targetingIndex
+	inventory   *targetingIndex
+	sizes       *targetingIndex
+	segments    *targetingIndex
+	deals       *targetingIndex
+}
+
+func newCampaignIndex(campaigns []*Campaign) (*campaignIndex, error) {
+	x := &campaignIndex{
+		campaigns: campaigns,
+		byID:      make(map[string]*Campaign, len(campaigns)),
+		creatives: make(map[string]*Creative),
+	}
+
+	for _, c := range campaigns {
+		if _, ok := x.byID[c.ID]; ok {
+			return nil, fmt.Errorf("duplicate campaign %#v", c.ID)
+		}
+		x.byID[c.ID] = c
+		for _, cr := range c.Creatives {
+			if err := cr.Validate(); err != nil {
+				return nil, fmt.Errorf("campaign %#v: %+v", c.ID, err)
+			}
+			if _, ok := x.creatives[cr.ID]; ok {
+				return nil, fmt.Errorf("campaign %#v: duplicate creative %#v", c.ID, cr.ID)
+			}
+			x.creatives[cr.ID] = cr
+		}
+		lineItems := make(map[string]bool, len(c.LineItems))
+		for _, li := range c.LineItems {
+			if lineItems[li.ID] {
+				return nil, fmt.Errorf("campaign %#v: duplicate line item %#v", c.ID, li.ID)
+			}
+			lineItems[li.ID] = true
+			li.Campaign = c
+			li.index = len(x.lineItems)
+			li.location = time.UTC
+			if li.Targeting.Timezone != "" {
+				loc, err := time.LoadLocation(li.Targeting.Timezone)
+				if err != nil {
+					return nil, fmt.Errorf("line item %#v: %+v", li.ID, err)
+				}
+				li.location = loc
+			}
+			switch li.Model {
+			case "", "cpm", "cpc":
+			default:
+				return nil, fmt.Errorf("line item %#v: unsupported model %#v", li.ID, li.Model)
+			}
+			if len(li.Creatives) == 0 {
+				return nil, fmt.Errorf("line item %#v of campaign %#v has no creatives", li.ID, c.ID)
+			}
+			li.creatives = nil
+			for _, id := range li.Creatives {
+				cr := x.creatives[id]
+				if cr == nil || !containsCreative(c.Creatives, cr) {
+					return nil, fmt.Errorf("line item %#v: unknown creative %#v of campaign %#v", li.ID, id, c.ID)
+				}
+				li.creatives = append(li.creatives, cr)
+			}
+			x.lineItems = append(x.lineItems, li)
+		}
+	}
+
+	n := len(x.lineItems)
+	x.countries = newTargetingIndex(n)
+	x.regions = newTargetingIndex(n)
+	x.deviceTypes = newTargetingIndex(n)
+	x.os = newTargetingIndex(n)
+	x.inventory = newTargetingIndex(n)
+	x.sizes = newTargetingIndex(n)
+	x.segments = newTargetingIndex(n)
+	x.deals = newTargetingIndex(n)
+
+	for i, li := range x.lineItems {
+		t := &li.Targeting
+
+		countries := make([]string, len(t.Countries))
+		for j, s := range t.Countries {
+			countries[j] = strings.ToUpper(s)
+		}
+		x.countries.add(i, n, countries)
+
+		regions := make([]string, len(t.Regions))
+		for j, s := range t.Regions {
+			regions[j] = strings.ToUpper(s)
+		}
+		x.regions.add(i, n, regions)
+
+		deviceTypes := make([]string, len(t.DeviceTypes))
+		for j, v := range t.DeviceTypes {
+			deviceTypes[j] = strconv.Itoa(v)
+		}
+		x.deviceTypes.add(i, n, deviceTypes)
+
+		os := make([]string, len(t.OS))
+		for j, s := range t.OS {
+			os[j] = strings.ToLower(s)
+		}
+		x.os.add(i, n, os)
+
+		var inventory []string
+		for _, s := range t.Domains {
+			inventory = append(inventory, "domain:"+normalizeDomain(s))
+		}
+		for _, s := range t.Bundles {
+			inventory = append(inventory, "bundle:"+strings.ToLower(s))
+		}
+		x.inventory.add(i, n, inventory)
+
+		x.sizes.add(i, n, t.Sizes)
+		x.segments.add(i, n, t.Segments)
+		x.deals.add(i, n, t.Deals)
+	}
+
+	return x, nil
+}
+
+// match returns the line items eligible for imp of bctx, it intersects the
+// indexes of each dimension and checks the time of day of the survivors.
+func (x *campaignIndex) match(bctx *BidContext, imp *Imp) []*LineItem {
+	if len(x.lineItems) == 0 {
+		return nil
+	}
+
+	req := bctx.Request
+
+	candidates := newBitset(len(x.lineItems))
+	for i := range candidates {
+		candidates[i] = ^uint64(0)
+	}
+
+	x.countries.filter(candidates, strings.ToUpper(bctx.Country))
+	x.regions.filter(candidates, strings.ToUpper(bctx.Country+"-"+bctx.Region))
+
+	if req.Device != nil {
+		x.deviceTypes.filter(candidates, strconv.Itoa(req.Device.DeviceType))
+		x.os.filter(candidates, strings.ToLower(req.Device.OS))
+	} else {
+		x.deviceTypes.filter(candidates)
+		x.os.filter(candidates)
+	}
+
+	switch {
+	case req.Site != nil:
+		x.inventory.filter(candidates, "domain:"+normalizeDomain(req.Site.Domain))
+	case req.App != nil:
+		x.inventory.filter(candidates, "bundle:"+strings.ToLower(req.App.Bundle))
+	default:
+		x.inventory.filter(candidates)
+	}
+
+	x.sizes.filter(candidates, ImpSizes(imp)...)
+
+	if bctx.Profile != nil {
+		x.segments.filter(candidates, bctx.Profile.Segments...)
+	} else {
+		x.segments.filter(candidates)
+	}
+
+	var deals []string
+	if imp.PMP != nil {
+		for _, d := range imp.PMP.Deals {
+			deals = append(deals, d.ID)
+		}
+	}
+	x.deals.filter(candidates, deals...)
+
+	var items []*LineItem
+	candidates.each(func(i int) {
+		if i >= len(x.lineItems) {
+			return
+		}
+		li := x.lineItems[i]
+		if len(li.Targeting.Hours) > 0 {
+			hour := bctx.Now.In(li.location).Hour()
+			found := false
+			for _, h := range li.Targeting.Hours {
+				if h == hour {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return
+			}
+		}
+		items = append(items, li)
+	})
+
+	return items
+}
+
+func containsCreative(creatives []*Creative, cr *Creative) bool {
+	for _, v := range creatives {
+		if v == cr {
+			return true
+		}
+	}
+	return false
+}
+
+// ImpSizes returns the "WxH" sizes accepted by imp.
+func ImpSizes(imp *Imp) []string {
+	var sizes []string
+	if b := imp.Banner; b != nil {
+		if b.W > 0 && b.H > 0 {
+			sizes = append(sizes, strconv.Itoa(b.W)+"x"+strconv.Itoa(b.H))
+		}
+		for _, f := range b.Format {
+			if f.W > 0 && f.H > 0 {
+				sizes = append(sizes, strconv.Itoa(f.W)+"x"+strconv.Itoa(f.H))
+			}
+		}
+	}
+	if v := imp.Video; v != nil && v.W > 0 && v.H > 0 {
+		sizes = append(sizes, strconv.Itoa(v.W)+"x"+strconv.Itoa(v.H))
+	}
+	return sizes
+}
+
+func normalizeDomain(s string) string {
+	return strings.TrimPrefix(strings.ToLower(s), "www.")
+}
+
+// CampaignCatalog holds the campaigns loaded from File, or from the "json" bin
+// of the "catalog" record of Set in Store. It is reloaded when File changes,
+// or every minute from Store.
+type CampaignCatalog struct {
+	File  string
+	Store BidStore
+	Set   string
+
+	index atomic.Value // *campaignIndex
+}
+
+// Load replaces the campaigns, on error the previously loaded ones are kept.
+func (c *CampaignCatalog) Load() error {
+	var data []byte
+	var err error
+
+	switch {
+	case c.File != "":
+		data, err = ioutil.ReadFile(c.File)
+	case c.Set != "":
+		var bins map[string]interface{}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		bins, err = c.Store.Get(ctx, c.Set, "catalog")
+		cancel()
+		if err != nil {
+			break
+		}
+		if bins == nil {
+			err = fmt.Errorf("campaign catalog record of set %#v is not found", c.Set)
+			break
+		}
+		s, ok := bins["json"].(string)
+		if !ok {
+			err = fmt.Errorf("campaign catalog record of set %#v has no json string bin", c.Set)
+			break
+		}
+		data = []byte(s)
+	}
+	if err != nil {
+		return err
+	}
+
+	var campaigns []*Campaign
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &campaigns); err != nil {
+			return fmt.Errorf("json.Unmarshal(campaigns) error: %+v", err)
+		}
+	}
+
+	x, err := newCampaignIndex(campaigns)
+	if err != nil {
+		return err
+	}
+
+	c.index.Store(x)
+
+	glog.Infos().Int("campaigns", len(x.campaigns)).Int("line_items", len(x.lineItems)).Msg("campaign catalog loaded")
+
+	return nil
+}
+
+// Match returns the line items eligible for imp.
+func (c *CampaignCatalog) Match(bctx *BidContext, imp *Imp) []*LineItem {
+	x, _ := c.index.Load().(*campaignIndex)
+	if x == nil {
+		return nil
+	}
+	return x.match(bctx, imp)
+}
+
+// Creative returns the creative of id, or nil if it is not found.
+func (c *CampaignCatalog) Creative(id string) *Creative {
+	x, _ := c.index.Load().(*campaignIndex)
+	if x == nil {
+		return nil
+	}
+	return x.creatives[id]
+}
+
+// Campaigns returns the loaded campaigns.
+func (c *CampaignCatalog) Campaigns() []*Campaign {
+	x, _ := c.index.Load().(*campaignIndex)
+	if x == nil {
+		return nil
+	}
+	return x.campaigns
+}
+
+// Campaign returns the campaign of id, or nil if it is not found.
+func (c *CampaignCatalog) Campaign(id string) *Campaign {
+	x, _ := c.index.Load().(*campaignIndex)
+	if x == nil {
+		return nil
+	}
+	return x.byID[id]
+}
+
+func (c *CampaignCatalog) Watcher() {
+	if c.File == "" {
+		if c.Set == "" {
+			return
+		}
+		for range time.Tick(time.Minute) {
+			if err := c.Load(); err != nil {
+				glog.Errors().Err(err).Str("set", c.Set).Msg("reload campaign catalog error")
+			}
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Fatals().Err(err).Msg("fsnotify.NewWatcher() error")
+	}
+	defer watcher.Close()
+
+	filename, _ := filepath.Abs(c.File)
+	if err := watcher.Add(filepath.Dir(filename)); err != nil {
+		glog.Errors().Err(err).Str("filename", filename).Msg("watcher.Add(...) error")
+		return
+	}
+
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Name != filename || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			glog.Infos().Str("filename", filename).Msg("modified campaign file")
+			if err := c.Load(); err != nil {
+				glog.Errors().Err(err).Str("filename", filename).Msg("reload campaign catalog error")
+			}
+		case err := <-watcher.Errors:
+			glog.Errors().Err(err).Msg("watch campaign file error")
+		}
+	}
+}
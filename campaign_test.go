@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCampaignIndexMatch(t *testing.T) {
+	campaigns := []*Campaign{
+		{
+			ID: "c1",
+			LineItems: []*LineItem{
+				{ID: "any"},
+				{ID: "us-mobile", Targeting: Targeting{Countries: []string{"us"}, DeviceTypes: []int{DeviceTypePhone}}},
+				{ID: "domain", Targeting: Targeting{Domains: []string{"example.com"}}},
+				{ID: "bundle", Targeting: Targeting{Bundles: []string{"com.example"}}},
+				{ID: "size", Targeting: Targeting{Sizes: []string{"728x90"}}},
+				{ID: "segment", Targeting: Targeting{Segments: []string{"auto", "sports"}}},
+				{ID: "night", Targeting: Targeting{Hours: []int{0, 1, 2}, Timezone: "Asia/Shanghai"}},
+			},
+		},
+	}
+
+	campaigns[0].Creatives = []*Creative{{ID: "cr1", Format: "banner", W: 300, H: 250, Template: "x"}}
+	for _, li := range campaigns[0].LineItems {
+		li.Creatives = []string{"cr1"}
+	}
+
+	x, err := newCampaignIndex(campaigns)
+	if err != nil {
+		t.Fatalf("newCampaignIndex() error: %+v", err)
+	}
+
+	imp := &Imp{ID: "1", Banner: &Banner{W: 300, H: 250, Format: []Format{{W: 728, H: 90}}}}
+
+	var cases = []struct {
+		bctx *BidContext
+		ids  []string
+	}{
+		{
+			&BidContext{
+				Request: &BidRequest{Site: &Site{Domain: "www.Example.com"}, Device: &Device{DeviceType: DeviceTypePhone}},
+				Country: "US",
+				Now:     time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+			},
+			[]string{"any", "domain", "size", "us-mobile"},
+		},
+		{
+			&BidContext{
+				Request: &BidRequest{App: &App{Bundle: "com.example"}},
+				Profile: &Profile{Segments: []string{"sports"}},
+				Country: "CN",
+				Now:     time.Date(2026, 1, 1, 17, 0, 0, 0, time.UTC),
+			},
+			[]string{"any", "bundle", "night", "segment", "size"},
+		},
+	}
+
+	for i, c := range cases {
+		var ids []string
+		for _, li := range x.match(c.bctx, imp) {
+			ids = append(ids, li.ID)
+		}
+		sort.Strings(ids)
+		if len(ids) != len(c.ids) {
+			t.Errorf("case #%d match() return %v, not match %v", i, ids, c.ids)
+			continue
+		}
+		for j := range ids {
+			if ids[j] != c.ids[j] {
+				t.Errorf("case #%d match() return %v, not match %v", i, ids, c.ids)
+				break
+			}
+		}
+	}
+}
+
+func TestCampaignIndexDuplicate(t *testing.T) {
+	newCreative := func() *Creative {
+		return &Creative{ID: "cr1", Format: "banner", W: 300, H: 250, Template: "x"}
+	}
+
+	cases := []struct {
+		Name      string
+		Campaigns []*Campaign
+	}{
+		{"campaign", []*Campaign{{ID: "c1"}, {ID: "c1"}}},
+		{"line item", []*Campaign{{
+			ID:        "c1",
+			Creatives: []*Creative{newCreative()},
+			LineItems: []*LineItem{{ID: "li1", Creatives: []string{"cr1"}}, {ID: "li1", Creatives: []string{"cr1"}}},
+		}}},
+	}
+
+	for _, c := range cases {
+		if _, err := newCampaignIndex(c.Campaigns); err == nil {
+			t.Errorf("newCampaignIndex() should reject a duplicate %s", c.Name)
+		}
+	}
+
+	// line item ids are scoped by campaign
+	_, err := newCampaignIndex([]*Campaign{
+		{ID: "c1", Creatives: []*Creative{newCreative()}, LineItems: []*LineItem{{ID: "li1", Creatives: []string{"cr1"}}}},
+		{ID: "c2", Creatives: []*Creative{{ID: "cr2", Format: "banner", W: 300, H: 250, Template: "x"}}, LineItems: []*LineItem{{ID: "li1", Creatives: []string{"cr2"}}}},
+	})
+	if err != nil {
+		t.Errorf("newCampaignIndex() error: %+v", err)
+	}
+}
+
+func TestCampaignCatalogLoadStore(t *testing.T) {
+	store := NewMemoryBidStore()
+	c := &CampaignCatalog{Store: store, Set: "campaigns"}
+
+	if err := c.Load(); err == nil {
+		t.Errorf("Load() of a missing record should return an error")
+	}
+
+	store.Put(context.Background(), "campaigns", "catalog", map[string]interface{}{"json": `[{"id":"c1"}]`}, 0)
+	if err := c.Load(); err != nil {
+		t.Fatalf("Load() error: %+v", err)
+	}
+	if n := len(c.Campaigns()); n != 1 {
+		t.Fatalf("Campaigns() return %d campaigns, not match %d", n, 1)
+	}
+
+	store.Put(context.Background(), "campaigns", "catalog", map[string]interface{}{"json": 42}, 0)
+	if err := c.Load(); err == nil {
+		t.Errorf("Load() of a non string json bin should return an error")
+	}
+	if n := len(c.Campaigns()); n != 1 {
+		t.Errorf("Campaigns() return %d campaigns after a failed Load, not match %d", n, 1)
+	}
+}
@@ -18,16 +18,60 @@ type Config struct {
 		ListenAddr      string
 		TcpFastopen     bool
 		GracefulTimeout int
+		AdminToken      string
 	}
 	Ipinfo struct {
-		Url       string
-		Regex     string
-		CacheTtl  int
-		Ratelimit int
+		Url             string
+		Regex           string
+		Charset         string
+		CacheTtl        int
+		Timeout         int
+		Ratelimit       int
+		LimiterCapacity int
+		LimiterTtl      int
+
+		RatelimitBackend       string
+		RatelimitRedisAddr     string
+		RatelimitRedisPassword string
+
+		BreakerFailures    int
+		BreakerSlow        int
+		BreakerOpenTimeout int
+		MaxBodySize        int
+
+		Iplist []IPListFile
 	}
 	Bid struct {
-		AerospikeHost string
-		AerospikePort int
+		Store                string
+		AerospikeHost        string
+		AerospikePort        int
+		AerospikeNamespace   string
+		ProfileSet           string
+		CampaignFile         string
+		CampaignSet          string
+		GeoipFile            string
+		FrequencySet         string
+		SpendSet             string
+		SpendCacheTtl        int
+		NoticeSet            string
+		WinrateSet           string
+		WinrateWindow        int
+		PriceKey             []PriceKey
+		Exchange             []ExchangeConfig
+		NoticeUrl            string
+		NoticeSecret         string
+		DefaultTmax          int
+		DeadlineMargin       int
+		CurrencyRates        map[string]float64
+		Shading              bool
+		ShadingTargetWinrate float64
+		ShadingMinFactor     float64
+		ShadingMinBids       int
+		BidlogDir            string
+		BidlogMaxSize        int
+		BidlogMaxAge         int
+		BidlogQueueSize      int
+		BidlogSampling       map[string]float64
 	}
 }
 
@@ -37,10 +81,22 @@ func (c *Config) reload() error {
 		return err
 	}
 
-	if err = toml.Unmarshal(tomlData, &c); err != nil {
+	// decode into a new config, so an invalid file leaves c as it was.
+	nc := Config{uri: c.uri}
+	if err = toml.Unmarshal(tomlData, &nc); err != nil {
 		return fmt.Errorf("toml.Decode(%s) error: %+v", tomlData, err)
 	}
 
+	// a shaded price keeps this fraction of the bid price, 0.5 if unset.
+	switch f := nc.Bid.ShadingMinFactor; {
+	case f == 0:
+		nc.Bid.ShadingMinFactor = 0.5
+	case f < 0 || f > 1:
+		return fmt.Errorf("bid.shading_min_factor %v is not in (0, 1]", f)
+	}
+
+	*c = nc
+
 	return nil
 }
 
@@ -70,7 +126,9 @@ func (c *Config) Watcher() {
 		case event := <-watcher.Events:
 			if event.Op&fsnotify.Write == fsnotify.Write {
 				glog.Infos().Str("filename", filename).Str("event_name", event.Name).Msg("modified config file")
-				if c.reload() == nil {
+				if err := c.reload(); err != nil {
+					glog.Errors().Err(err).Str("filename", filename).Msg("reload config file error")
+				} else {
 					glog.Infos().Str("filename", filename).Msgf("%#v", c)
 				}
 			}
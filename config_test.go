@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigShadingMinFactor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		TOML   string
+		Factor float64
+		Error  bool
+	}{
+		{"[bid]\nshading_min_factor = 0.7\n", 0.7, false},
+		{"[bid]\nshading_min_factor = 1.0\n", 1, false},
+		{"[bid]\n", 0.5, false},
+		{"[bid]\nshading_min_factor = -0.2\n", 0.8, true},
+		{"[bid]\nshading_min_factor = 1.5\n", 0.8, true},
+		{"[bid\n", 0.8, true},
+	}
+
+	for _, c := range cases {
+		filename := filepath.Join(dir, "test.toml")
+		ioutil.WriteFile(filename, []byte(c.TOML), 0644)
+
+		// an invalid file keeps the loaded config
+		config := &Config{uri: filename}
+		config.Bid.ShadingMinFactor = 0.8
+		config.Bid.NoticeSet = "notice"
+		err := config.reload()
+		if c.Error && config.Bid.NoticeSet != "notice" {
+			t.Errorf("reload(%#v) should keep the loaded config", c.TOML)
+		}
+		if (err != nil) != c.Error || config.Bid.ShadingMinFactor != c.Factor {
+			t.Errorf("reload(%#v) return %v with shading_min_factor %v, not match %v", c.TOML, err, config.Bid.ShadingMinFactor, c.Factor)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Creative is an ad of a campaign. Format is "banner", "video" or "native",
+// Template is the markup with macros, see Render, and ClickURL is the landing
+// page behind the click tracker. ADomain defaults to the campaign's.
+type Creative struct {
+	ID       string   `json:"id"`
+	Format   string   `json:"format"`
+	W        int      `json:"w,omitempty"`
+	H        int      `json:"h,omitempty"`
+	MIME     string   `json:"mime,omitempty"`
+	Duration int      `json:"duration,omitempty"`
+	ADomain  []string `json:"adomain,omitempty"`
+	Cat      []string `json:"cat,omitempty"`
+	Attr     []int    `json:"attr,omitempty"`
+	ClickURL string   `json:"click_url,omitempty"`
+	Template string   `json:"template"`
+}
+
+// Validate checks the fields of cr.
+func (cr *Creative) Validate() error {
+	switch {
+	case cr.ID == "":
+		return fmt.Errorf("creative has no id")
+	case cr.Template == "":
+		return fmt.Errorf("creative %#v has no template", cr.ID)
+	}
+
+	switch cr.Format {
+	case "banner":
+		if cr.W <= 0 || cr.H <= 0 {
+			return fmt.Errorf("banner creative %#v has no size", cr.ID)
+		}
+	case "video":
+		if cr.MIME == "" {
+			return fmt.Errorf("video creative %#v has no mime", cr.ID)
+		}
+	case "native":
+	default:
+		return fmt.Errorf("creative %#v has unsupported format %#v", cr.ID, cr.Format)
+	}
+
+	if cr.ClickURL != "" {
+		if u, err := url.Parse(cr.ClickURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("creative %#v has invalid click_url %#v", cr.ID, cr.ClickURL)
+		}
+	}
+
+	return nil
+}
+
+// Advertisers returns the adomain of cr, or of its campaign c if cr has none.
+func (cr *Creative) Advertisers(c *Campaign) []string {
+	if len(cr.ADomain) == 0 && c != nil {
+		return c.ADomain
+	}
+	return cr.ADomain
+}
+
+// Fits reports whether cr of campaign c may serve imp of req, by format,
+// size, mime and duration, and by the blocked categories, advertisers and
+// attributes.
+func (cr *Creative) Fits(c *Campaign, req *BidRequest, imp *Imp) bool {
+	var battr []int
+	switch cr.Format {
+	case "banner":
+		if imp.Banner == nil || !HasString(ImpSizes(imp), strconv.Itoa(cr.W)+"x"+strconv.Itoa(cr.H)) {
+			return false
+		}
+		if cr.MIME != "" && len(imp.Banner.MIMEs) > 0 && !HasString(imp.Banner.MIMEs, cr.MIME) {
+			return false
+		}
+		battr = imp.Banner.BAttr
+	case "video":
+		v := imp.Video
+		if v == nil || (len(v.MIMEs) > 0 && !HasString(v.MIMEs, cr.MIME)) {
+			return false
+		}
+		if (v.MinDuration > 0 && cr.Duration < v.MinDuration) || (v.MaxDuration > 0 && cr.Duration > v.MaxDuration) {
+			return false
+		}
+		battr = v.BAttr
+	case "native":
+		if imp.Native == nil {
+			return false
+		}
+		battr = imp.Native.BAttr
+	default:
+		return false
+	}
+
+	for _, a := range cr.Attr {
+		for _, b := range battr {
+			if a == b {
+				return false
+			}
+		}
+	}
+	for _, c := range cr.Cat {
+		if HasString(req.BCat, c) {
+			return false
+		}
+	}
+	for _, d := range cr.Advertisers(c) {
+		if HasString(req.BAdv, d) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Render returns the markup of cr with the ${NAME} macros of macros replaced.
+// Macros not in macros, such as ${AUCTION_PRICE}, are left to the exchange.
+func (cr *Creative) Render(macros map[string]string) string {
+	oldnew := make([]string, 0, 2*len(macros))
+	for name, value := range macros {
+		oldnew = append(oldnew, "${"+name+"}", value)
+	}
+	return strings.NewReplacer(oldnew...).Replace(cr.Template)
+}
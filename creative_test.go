@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCreativeFits(t *testing.T) {
+	banner := &Creative{ID: "b1", Format: "banner", W: 300, H: 250, Cat: []string{"IAB3"}, Attr: []int{6}, Template: "x"}
+	video := &Creative{ID: "v1", Format: "video", MIME: "video/mp4", Duration: 15, Template: "x"}
+	campaign := &Campaign{ID: "c1", ADomain: []string{"example.com"}}
+
+	cases := []struct {
+		Creative *Creative
+		Campaign *Campaign
+		Request  BidRequest
+		Imp      Imp
+		Fits     bool
+	}{
+		{banner, nil, BidRequest{}, Imp{Banner: &Banner{Format: []Format{{W: 728, H: 90}, {W: 300, H: 250}}}}, true},
+		{banner, nil, BidRequest{}, Imp{Banner: &Banner{W: 320, H: 50}}, false},
+		{banner, nil, BidRequest{}, Imp{Video: &Video{MIMEs: []string{"video/mp4"}}}, false},
+		{banner, nil, BidRequest{BCat: []string{"IAB3"}}, Imp{Banner: &Banner{W: 300, H: 250}}, false},
+		{banner, nil, BidRequest{}, Imp{Banner: &Banner{W: 300, H: 250, BAttr: []int{6}}}, false},
+		{video, nil, BidRequest{}, Imp{Video: &Video{MIMEs: []string{"video/mp4"}, MaxDuration: 30}}, true},
+		{video, nil, BidRequest{}, Imp{Video: &Video{MIMEs: []string{"video/webm"}}}, false},
+		{video, nil, BidRequest{}, Imp{Video: &Video{MIMEs: []string{"video/mp4"}, MinDuration: 30}}, false},
+		// the adomain of the campaign is blocked
+		{banner, campaign, BidRequest{BAdv: []string{"example.com"}}, Imp{Banner: &Banner{W: 300, H: 250}}, false},
+		{banner, campaign, BidRequest{BAdv: []string{"other.com"}}, Imp{Banner: &Banner{W: 300, H: 250}}, true},
+	}
+
+	for _, c := range cases {
+		if fits := c.Creative.Fits(c.Campaign, &c.Request, &c.Imp); fits != c.Fits {
+			t.Errorf("Fits(%#v, %#v) return %#v, not match %#v", c.Creative.ID, c.Imp, fits, c.Fits)
+		}
+	}
+}
+
+func TestCreativeRender(t *testing.T) {
+	cr := &Creative{Template: `<a href="${CLICK_URL}"><img src="${IMP_URL}&p=${AUCTION_PRICE}"></a>`}
+
+	adm := cr.Render(map[string]string{"CLICK_URL": "http://c", "IMP_URL": "http://i?a=1"})
+	if want := `<a href="http://c"><img src="http://i?a=1&p=${AUCTION_PRICE}"></a>`; adm != want {
+		t.Errorf("Render() return %#v, not match %#v", adm, want)
+	}
+}
+
+func TestCampaignIndexCreatives(t *testing.T) {
+	cr := &Creative{ID: "cr1", Format: "banner", W: 300, H: 250, Template: "x"}
+
+	x, err := newCampaignIndex([]*Campaign{{
+		ID:        "c1",
+		Creatives: []*Creative{cr},
+		LineItems: []*LineItem{{ID: "li1", Creatives: []string{"cr1"}}},
+	}})
+	if err != nil {
+		t.Fatalf("newCampaignIndex() error: %+v", err)
+	}
+
+	li := x.lineItems[0]
+	if got := li.Creative(&BidRequest{}, &Imp{Banner: &Banner{W: 300, H: 250}}); got != cr {
+		t.Errorf("Creative() return %#v, not match %#v", got, cr)
+	}
+
+	_, err = newCampaignIndex([]*Campaign{
+		{ID: "c1", Creatives: []*Creative{cr}},
+		{ID: "c2", LineItems: []*LineItem{{ID: "li2", Creatives: []string{"cr1"}}}},
+	})
+	if err == nil {
+		t.Errorf("newCampaignIndex() should reject a creative of another campaign")
+	}
+
+	_, err = newCampaignIndex([]*Campaign{{ID: "c1", Creatives: []*Creative{{ID: "cr2", Format: "banner", Template: "x"}}}})
+	if err == nil {
+		t.Errorf("newCampaignIndex() should reject a banner creative without size")
+	}
+
+	_, err = newCampaignIndex([]*Campaign{{ID: "c1", Creatives: []*Creative{cr}, LineItems: []*LineItem{{ID: "li1"}}}})
+	if err == nil {
+		t.Errorf("newCampaignIndex() should reject a line item without creatives")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CurrencyRates maps ISO-4217 currency codes to their value in USD.
+type CurrencyRates map[string]float64
+
+func (r CurrencyRates) rate(cur string) (float64, error) {
+	cur = strings.ToUpper(cur)
+	if cur == "" || cur == "USD" {
+		return 1, nil
+	}
+
+	rate, ok := r[cur]
+	if !ok || rate <= 0 {
+		return 0, fmt.Errorf("unknown currency %#v", cur)
+	}
+
+	return rate, nil
+}
+
+// ToUSD converts amount in cur to USD, an empty cur is USD.
+func (r CurrencyRates) ToUSD(amount float64, cur string) (float64, error) {
+	rate, err := r.rate(cur)
+	if err != nil {
+		return 0, err
+	}
+	return amount * rate, nil
+}
+
+// FromUSD converts amount in USD to cur.
+func (r CurrencyRates) FromUSD(amount float64, cur string) (float64, error) {
+	rate, err := r.rate(cur)
+	if err != nil {
+		return 0, err
+	}
+	return amount / rate, nil
+}
+
+// BidCurrency returns the currency to bid in among the allowed currencies of
+// req, preferring USD, or "" if none of them is known.
+func (r CurrencyRates) BidCurrency(req *BidRequest) string {
+	if len(req.Cur) == 0 {
+		return "USD"
+	}
+
+	for _, cur := range req.Cur {
+		if strings.ToUpper(cur) == "USD" {
+			return "USD"
+		}
+	}
+
+	for _, cur := range req.Cur {
+		if _, err := r.rate(cur); err == nil {
+			return strings.ToUpper(cur)
+		}
+	}
+
+	return ""
+}
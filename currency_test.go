@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCurrencyRates(t *testing.T) {
+	rates := CurrencyRates{"EUR": 1.25, "JPY": 0.01}
+
+	cases := []struct {
+		Amount float64
+		Cur    string
+		USD    float64
+		Error  bool
+	}{
+		{2, "", 2, false},
+		{2, "USD", 2, false},
+		{2, "eur", 2.5, false},
+		{100, "JPY", 1, false},
+		{2, "XXX", 0, true},
+	}
+
+	for _, c := range cases {
+		usd, err := rates.ToUSD(c.Amount, c.Cur)
+		if usd != c.USD || (err != nil) != c.Error {
+			t.Errorf("ToUSD(%#v, %#v) return %#v, %v, not match %#v", c.Amount, c.Cur, usd, err, c.USD)
+		}
+	}
+
+	if amount, _ := rates.FromUSD(2.5, "EUR"); amount != 2 {
+		t.Errorf("FromUSD(2.5, \"EUR\") return %#v, not match 2", amount)
+	}
+
+	bidCases := []struct {
+		Cur []string
+		Bid string
+	}{
+		{nil, "USD"},
+		{[]string{"EUR", "USD"}, "USD"},
+		{[]string{"JPY"}, "JPY"},
+		{[]string{"XXX", "eur"}, "EUR"},
+		{[]string{"XXX"}, ""},
+	}
+
+	for _, c := range bidCases {
+		if cur := rates.BidCurrency(&BidRequest{Cur: c.Cur}); cur != c.Bid {
+			t.Errorf("BidCurrency(%#v) return %#v, not match %#v", c.Cur, cur, c.Bid)
+		}
+	}
+}
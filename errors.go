@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/phuslu/glog"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	ErrCodeInvalidRequest     = "invalid_request"
+	ErrCodeInvalidIP          = "invalid_ip"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeUpstreamError      = "upstream_error"
+	ErrCodeUpstreamTimeout    = "upstream_timeout"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeMethodNotAllowed   = "method_not_allowed"
+	ErrCodeInternalError      = "internal_error"
+	ErrCodeServiceUnavailable = "service_unavailable"
+)
+
+// APIError is the error returned to clients by all handlers. Clients branch
+// on Code, Message is for humans and Err is the internal cause which is only
+// logged.
+type APIError struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RequestID  string `json:"request_id,omitempty"`
+
+	Err error `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Message + ": " + e.Err.Error()
+	}
+	return e.Code + ": " + e.Message
+}
+
+type APIErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+// WriteError logs err with its internal cause and writes it to ctx as json.
+func WriteError(ctx *fasthttp.RequestCtx, err *APIError) {
+	err.RequestID = RequestID(ctx)
+
+	if err.StatusCode >= fasthttp.StatusInternalServerError {
+		glog.Errors().Str("request_id", err.RequestID).Int("status_code", err.StatusCode).Str("remote_addr", ctx.RemoteAddr().String()).Str("url", ctx.URI().String()).Msg(err.Error())
+	} else {
+		glog.Warnings().Str("request_id", err.RequestID).Int("status_code", err.StatusCode).Str("remote_addr", ctx.RemoteAddr().String()).Str("url", ctx.URI().String()).Msg(err.Error())
+	}
+
+	ctx.SetStatusCode(err.StatusCode)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(APIErrorResponse{
+		Error: err,
+	})
+}
+
+// RequestID returns the X-Request-Id of ctx, a random one is generated and
+// echoed back if the client does not send it.
+func RequestID(ctx *fasthttp.RequestCtx) string {
+	if v, ok := ctx.UserValue("request_id").(string); ok {
+		return v
+	}
+
+	id := string(ctx.Request.Header.Peek("X-Request-Id"))
+	if id == "" || len(id) > 128 {
+		id = RandomHex(8)
+	}
+
+	ctx.SetUserValue("request_id", id)
+	ctx.Response.Header.Set("X-Request-Id", id)
+
+	return id
+}
+
+// WithRequestID wraps h to echo the request id on every response.
+func WithRequestID(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		RequestID(ctx)
+		h(ctx)
+	}
+}
+
+// WithAdminToken wraps h to require token as the bearer Authorization header,
+// all requests are forbidden if token is empty.
+func WithAdminToken(token string, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		auth := ctx.Request.Header.Peek("Authorization")
+		if token == "" || !bytes.HasPrefix(auth, []byte("Bearer ")) || subtle.ConstantTimeCompare(auth[len("Bearer "):], []byte(token)) != 1 {
+			WriteError(ctx, &APIError{
+				StatusCode: fasthttp.StatusForbidden,
+				Code:       ErrCodeForbidden,
+				Message:    "admin token required",
+			})
+			return
+		}
+		h(ctx)
+	}
+}
+
+func NotFound(ctx *fasthttp.RequestCtx) {
+	WriteError(ctx, &APIError{
+		StatusCode: fasthttp.StatusNotFound,
+		Code:       ErrCodeNotFound,
+		Message:    "no such route",
+	})
+}
+
+func MethodNotAllowed(ctx *fasthttp.RequestCtx) {
+	WriteError(ctx, &APIError{
+		StatusCode: fasthttp.StatusMethodNotAllowed,
+		Code:       ErrCodeMethodNotAllowed,
+		Message:    "method not allowed",
+	})
+}
+
+func PanicHandler(ctx *fasthttp.RequestCtx, v interface{}) {
+	ctx.ResetBody()
+	WriteError(ctx, &APIError{
+		StatusCode: fasthttp.StatusInternalServerError,
+		Code:       ErrCodeInternalError,
+		Message:    "internal error",
+		Err:        fmt.Errorf("panic: %+v", v),
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newTestRequestCtx(uri string, headers map[string]string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.SetRequestURI(uri)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, nil)
+
+	return &ctx
+}
+
+func TestRequestID(t *testing.T) {
+	cases := []struct {
+		Header string
+		Echo   bool
+	}{
+		{"abc-123", true},
+		{"", false},
+		{strings.Repeat("x", 129), false},
+	}
+
+	for _, c := range cases {
+		ctx := newTestRequestCtx("/", map[string]string{"X-Request-Id": c.Header})
+
+		id := RequestID(ctx)
+		if c.Echo && id != c.Header {
+			t.Errorf("RequestID(%#v) return %#v, not match", c.Header, id)
+		}
+		if !c.Echo && (id == c.Header || len(id) != 16) {
+			t.Errorf("RequestID(%#v) return %#v, should generate an id", c.Header, id)
+		}
+		if h := string(ctx.Response.Header.Peek("X-Request-Id")); h != id {
+			t.Errorf("RequestID(%#v) echo %#v, not match %#v", c.Header, h, id)
+		}
+		if again := RequestID(ctx); again != id {
+			t.Errorf("RequestID(%#v) return %#v again, not match %#v", c.Header, again, id)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	ctx := newTestRequestCtx("/x", map[string]string{"X-Request-Id": "r1"})
+
+	WriteError(ctx, &APIError{
+		StatusCode: fasthttp.StatusBadGateway,
+		Code:       ErrCodeUpstreamError,
+		Message:    "upstream error",
+		Err:        net.UnknownNetworkError("secret detail"),
+	})
+
+	if ctx.Response.StatusCode() != fasthttp.StatusBadGateway {
+		t.Errorf("WriteError() status %d, not match %d", ctx.Response.StatusCode(), fasthttp.StatusBadGateway)
+	}
+
+	body := string(ctx.Response.Body())
+	if want := `{"error":{"code":"upstream_error","message":"upstream error","request_id":"r1"}}`; strings.TrimSpace(body) != want {
+		t.Errorf("WriteError() body %s, not match %s", body, want)
+	}
+}
+
+func TestErrorHandlers(t *testing.T) {
+	cases := []struct {
+		Handler    fasthttp.RequestHandler
+		StatusCode int
+		Code       string
+	}{
+		{NotFound, fasthttp.StatusNotFound, ErrCodeNotFound},
+		{MethodNotAllowed, fasthttp.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{func(ctx *fasthttp.RequestCtx) { ctx.WriteString("partial"); PanicHandler(ctx, "boom") }, fasthttp.StatusInternalServerError, ErrCodeInternalError},
+	}
+
+	for _, c := range cases {
+		ctx := newTestRequestCtx("/x", nil)
+		c.Handler(ctx)
+
+		var resp APIErrorResponse
+		if err := json.Unmarshal(ctx.Response.Body(), &resp); err != nil || resp.Error == nil {
+			t.Fatalf("handler body %s is not an error response: %+v", ctx.Response.Body(), err)
+		}
+		if ctx.Response.StatusCode() != c.StatusCode || resp.Error.Code != c.Code || resp.Error.RequestID == "" {
+			t.Errorf("handler return %d %#v, not match %d %#v", ctx.Response.StatusCode(), resp.Error, c.StatusCode, c.Code)
+		}
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	ctx := newTestRequestCtx("/", nil)
+
+	WithRequestID(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	})(ctx)
+
+	if len(ctx.Response.Header.Peek("X-Request-Id")) == 0 {
+		t.Errorf("WithRequestID() should set X-Request-Id on a successful response")
+	}
+}
+
+func TestWithAdminToken(t *testing.T) {
+	cases := []struct {
+		Token      string
+		Auth       string
+		StatusCode int
+	}{
+		{"s3cret", "Bearer s3cret", fasthttp.StatusOK},
+		{"s3cret", "Bearer wrong", fasthttp.StatusForbidden},
+		{"s3cret", "s3cret", fasthttp.StatusForbidden},
+		{"s3cret", "", fasthttp.StatusForbidden},
+		{"", "Bearer ", fasthttp.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		ctx := newTestRequestCtx("/admin/spend", map[string]string{"Authorization": c.Auth})
+		WithAdminToken(c.Token, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetStatusCode(fasthttp.StatusOK)
+		})(ctx)
+
+		if ctx.Response.StatusCode() != c.StatusCode {
+			t.Errorf("WithAdminToken(%#v) with %#v return %d, not match %d", c.Token, c.Auth, ctx.Response.StatusCode(), c.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ExchangeConfig configures an exchange bidding on /bid/:exchange. Requests
+// are authenticated when they come from AllowIp or carry Secret, and are open
+// if neither is set. SpendOn is the notice which charges the impression of a
+// bid, "win" (the default) or "bill" for exchanges firing the billing url.
+type ExchangeConfig struct {
+	Name    string
+	Adapter string
+	Seat    string
+	AllowIp []string
+	Secret  string
+	SpendOn string
+}
+
+// ExchangeAdapter converts the OpenRTB dialect of an exchange.
+type ExchangeAdapter interface {
+	// Normalize moves the extensions in body of req into the internal model.
+	Normalize(body []byte, req *BidRequest) error
+	// Respond applies the quirks of the exchange to resp, which is nil for a
+	// no-bid. A nil return is sent as 204.
+	Respond(req *BidRequest, resp *BidResponse) *BidResponse
+}
+
+var ExchangeAdapters = map[string]ExchangeAdapter{
+	"openrtb":   OpenRTBAdapter{},
+	"openrtb26": OpenRTB26Adapter{},
+	"google":    GoogleAdapter{},
+}
+
+type Exchange struct {
+	Name    string
+	Seat    string
+	Adapter ExchangeAdapter
+	Allow   *IPTree
+	Secret  string
+	SpendOn string
+}
+
+// NewExchange returns the exchange of c, the adapter defaults to "openrtb".
+func NewExchange(c ExchangeConfig) (*Exchange, error) {
+	if c.Adapter == "" {
+		c.Adapter = "openrtb"
+	}
+
+	adapter, ok := ExchangeAdapters[c.Adapter]
+	if !ok {
+		return nil, fmt.Errorf("unsupported adapter %#v of exchange %#v", c.Adapter, c.Name)
+	}
+
+	switch c.SpendOn {
+	case "":
+		c.SpendOn = "win"
+	case "win", "bill":
+	default:
+		return nil, fmt.Errorf("unsupported spend_on %#v of exchange %#v", c.SpendOn, c.Name)
+	}
+
+	x := &Exchange{
+		Name:    c.Name,
+		Seat:    c.Seat,
+		Adapter: adapter,
+		Secret:  c.Secret,
+		SpendOn: c.SpendOn,
+	}
+
+	if len(c.AllowIp) > 0 {
+		x.Allow = &IPTree{}
+		for _, s := range c.AllowIp {
+			ipnet, err := ParseIPNet(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allow_ip %#v of exchange %#v: %+v", s, c.Name, err)
+			}
+			x.Allow.Insert(ipnet, c.Name)
+		}
+	}
+
+	return x, nil
+}
+
+// Authenticate reports whether the request of ctx comes from the exchange,
+// the secret is sent in the X-Exchange-Secret or Bearer Authorization header.
+func (x *Exchange) Authenticate(ctx *fasthttp.RequestCtx) bool {
+	if x.Allow == nil && x.Secret == "" {
+		return true
+	}
+
+	if x.Allow != nil && len(x.Allow.Lookup(ctx.RemoteIP())) > 0 {
+		return true
+	}
+
+	if x.Secret != "" {
+		secret := ctx.Request.Header.Peek("X-Exchange-Secret")
+		if auth := ctx.Request.Header.Peek("Authorization"); len(secret) == 0 && bytes.HasPrefix(auth, []byte("Bearer ")) {
+			secret = auth[len("Bearer "):]
+		}
+		if subtle.ConstantTimeCompare(secret, []byte(x.Secret)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OpenRTBAdapter is the plain OpenRTB 2.5 dialect.
+type OpenRTBAdapter struct{}
+
+func (OpenRTBAdapter) Normalize(body []byte, req *BidRequest) error {
+	return nil
+}
+
+func (OpenRTBAdapter) Respond(req *BidRequest, resp *BidResponse) *BidResponse {
+	return resp
+}
+
+// OpenRTB26Adapter moves the OpenRTB 2.6 privacy fields back to the
+// extensions where 2.5 defines them.
+type OpenRTB26Adapter struct{}
+
+func (OpenRTB26Adapter) Normalize(body []byte, req *BidRequest) error {
+	var v struct {
+		Regs *struct {
+			GDPR      *int   `json:"gdpr"`
+			USPrivacy string `json:"us_privacy"`
+		} `json:"regs"`
+		User *struct {
+			Consent string `json:"consent"`
+		} `json:"user"`
+	}
+
+	if err := json.Unmarshal(body, &v); err != nil {
+		return err
+	}
+
+	if v.Regs != nil && req.Regs != nil {
+		ext := make(map[string]interface{})
+		if len(req.Regs.Ext) > 0 {
+			json.Unmarshal(req.Regs.Ext, &ext)
+		}
+		if v.Regs.GDPR != nil {
+			ext["gdpr"] = *v.Regs.GDPR
+		}
+		if v.Regs.USPrivacy != "" {
+			ext["us_privacy"] = v.Regs.USPrivacy
+		}
+		req.Regs.Ext, _ = json.Marshal(ext)
+	}
+
+	if v.User != nil && v.User.Consent != "" && req.User != nil {
+		ext := make(map[string]interface{})
+		if len(req.User.Ext) > 0 {
+			json.Unmarshal(req.User.Ext, &ext)
+		}
+		ext["consent"] = v.User.Consent
+		req.User.Ext, _ = json.Marshal(ext)
+	}
+
+	return nil
+}
+
+func (OpenRTB26Adapter) Respond(req *BidRequest, resp *BidResponse) *BidResponse {
+	return resp
+}
+
+// GoogleAdapter is the Google Authorized Buyers OpenRTB dialect, where each
+// bid must echo one of the billing ids of its impression. Normalize copies
+// the billing ids of imp.ext into Imp.BillingID.
+type GoogleAdapter struct{}
+
+type googleImpExt struct {
+	BillingID []int64 `json:"billing_id"`
+}
+
+func (GoogleAdapter) Normalize(body []byte, req *BidRequest) error {
+	for i := range req.Imp {
+		imp := &req.Imp[i]
+		if len(imp.Ext) == 0 {
+			continue
+		}
+		var ext googleImpExt
+		if err := json.Unmarshal(imp.Ext, &ext); err != nil {
+			return fmt.Errorf("invalid ext of imp %#v: %+v", imp.ID, err)
+		}
+		imp.BillingID = ext.BillingID
+	}
+	return nil
+}
+
+func (GoogleAdapter) Respond(req *BidRequest, resp *BidResponse) *BidResponse {
+	if resp == nil {
+		return nil
+	}
+
+	for i := range resp.SeatBid {
+		bids := resp.SeatBid[i].Bid[:0]
+		for _, bid := range resp.SeatBid[i].Bid {
+			var billingID []int64
+			for _, imp := range req.Imp {
+				if imp.ID == bid.ImpID {
+					billingID = imp.BillingID
+				}
+			}
+			if len(billingID) == 0 {
+				// google drops bids without a billing id
+				continue
+			}
+			bid.Ext, _ = json.Marshal(map[string]interface{}{"billing_id": billingID[0]})
+			bids = append(bids, bid)
+		}
+		resp.SeatBid[i].Bid = bids
+	}
+
+	return resp
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestExchangeAuthenticate(t *testing.T) {
+	x, err := NewExchange(ExchangeConfig{
+		Name:    "x1",
+		AllowIp: []string{"10.0.0.0/8"},
+		Secret:  "s3cret",
+	})
+	if err != nil {
+		t.Fatalf("NewExchange() error: %+v", err)
+	}
+
+	cases := []struct {
+		IP     string
+		Header string
+		Value  string
+		OK     bool
+	}{
+		{"10.1.2.3", "", "", true},
+		{"192.168.1.1", "", "", false},
+		{"192.168.1.1", "X-Exchange-Secret", "s3cret", true},
+		{"192.168.1.1", "Authorization", "Bearer s3cret", true},
+		{"192.168.1.1", "X-Exchange-Secret", "wrong", false},
+	}
+
+	for _, c := range cases {
+		var req fasthttp.Request
+		if c.Header != "" {
+			req.Header.Set(c.Header, c.Value)
+		}
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(c.IP)}, nil)
+
+		if ok := x.Authenticate(&ctx); ok != c.OK {
+			t.Errorf("Authenticate(%#v, %#v) return %#v, not match %#v", c.IP, c.Value, ok, c.OK)
+		}
+	}
+
+	if _, err := NewExchange(ExchangeConfig{Name: "x2", Adapter: "unknown"}); err == nil {
+		t.Errorf("NewExchange() should reject an unknown adapter")
+	}
+
+	if x.SpendOn != "win" {
+		t.Errorf("NewExchange() return spend on %#v, not match %#v", x.SpendOn, "win")
+	}
+	if _, err := NewExchange(ExchangeConfig{Name: "x3", SpendOn: "imp"}); err == nil {
+		t.Errorf("NewExchange() should reject an unknown spend_on")
+	}
+}
+
+func TestOpenRTB26AdapterNormalize(t *testing.T) {
+	body := []byte(`{"id":"1","imp":[{"id":"1"}],"regs":{"gdpr":1,"us_privacy":"1YNN"},"user":{"id":"u1","consent":"CO1"}}`)
+
+	var req BidRequest
+	json.Unmarshal(body, &req)
+
+	if err := (OpenRTB26Adapter{}).Normalize(body, &req); err != nil {
+		t.Fatalf("Normalize() error: %+v", err)
+	}
+
+	if s := string(req.Regs.Ext); s != `{"gdpr":1,"us_privacy":"1YNN"}` {
+		t.Errorf("Normalize() regs.ext %s, not match gdpr and us_privacy", s)
+	}
+	if s := string(req.User.Ext); s != `{"consent":"CO1"}` {
+		t.Errorf("Normalize() user.ext %s, not match consent", s)
+	}
+}
+
+func TestGoogleAdapterRespond(t *testing.T) {
+	req := &BidRequest{
+		ID: "1",
+		Imp: []Imp{
+			{ID: "1", Ext: []byte(`{"billing_id":[123,456]}`)},
+			{ID: "2"},
+		},
+	}
+	resp := &BidResponse{
+		ID:      "1",
+		SeatBid: []SeatBid{{Bid: []Bid{{ID: "b1", ImpID: "1"}, {ID: "b2", ImpID: "2"}}}},
+	}
+
+	if err := (GoogleAdapter{}).Normalize(nil, req); err != nil {
+		t.Fatalf("Normalize() error: %+v", err)
+	}
+	if !reflect.DeepEqual(req.Imp[0].BillingID, []int64{123, 456}) || req.Imp[1].BillingID != nil {
+		t.Errorf("Normalize() return billing ids %v and %v", req.Imp[0].BillingID, req.Imp[1].BillingID)
+	}
+
+	resp = GoogleAdapter{}.Respond(req, resp)
+
+	bids := resp.SeatBid[0].Bid
+	if len(bids) != 1 || bids[0].ID != "b1" || string(bids[0].Ext) != `{"billing_id":123}` {
+		t.Errorf("Respond() return %#v, not match the bid with billing id", bids)
+	}
+}
+
+func TestGoogleAdapterPlacements(t *testing.T) {
+	req := &BidRequest{
+		ID:   "1",
+		Site: &Site{ID: "s1"},
+		Imp: []Imp{
+			{ID: "1", TagID: "t1", Ext: []byte(`{"billing_id":[123]}`)},
+			{ID: "2", TagID: "t2"},
+		},
+	}
+	GoogleAdapter{}.Normalize(nil, req)
+
+	resp := &BidResponse{
+		ID:      "1",
+		SeatBid: []SeatBid{{Bid: []Bid{{ID: "b1", ImpID: "1"}, {ID: "b2", ImpID: "2"}}}},
+	}
+
+	// the bid on the imp without billing id is dropped, so is its placement.
+	resp = GoogleAdapter{}.Respond(req, resp)
+	if placements := bidPlacements(req, resp); !reflect.DeepEqual(placements, []string{"site:s1:t1"}) {
+		t.Errorf("bidPlacements() return %v", placements)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// FrequencyCap limits a user to Count impressions of a campaign per Period
+// seconds, the periods are fixed windows aligned to the unix epoch.
+type FrequencyCap struct {
+	Count  int `json:"count"`
+	Period int `json:"period"`
+}
+
+// FrequencyCapper counts impressions in the "n" bin of Set records keyed by
+// user, campaign and window, which expire with the window.
+type FrequencyCapper struct {
+	Store BidStore
+	Set   string
+}
+
+func (f *FrequencyCapper) key(userID, campaignID string, fc FrequencyCap, now time.Time) string {
+	window := now.Unix() / int64(fc.Period)
+	return userID + ":" + campaignID + ":" + strconv.Itoa(fc.Period) + ":" + strconv.FormatInt(window, 10)
+}
+
+// Allow reports whether the user is below all frequency caps of c. A capped
+// campaign is never allowed for an unknown user.
+func (f *FrequencyCapper) Allow(ctx context.Context, userID string, c *Campaign, now time.Time) (bool, error) {
+	if len(c.FrequencyCaps) == 0 {
+		return true, nil
+	}
+	if userID == "" {
+		return false, nil
+	}
+
+	for _, fc := range c.FrequencyCaps {
+		if fc.Period <= 0 {
+			continue
+		}
+
+		bins, err := f.Store.Get(ctx, f.Set, f.key(userID, c.ID, fc, now))
+		if err != nil {
+			return false, err
+		}
+
+		if ToInt64(bins["n"]) >= int64(fc.Count) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Record counts an impression of c for the user.
+func (f *FrequencyCapper) Record(ctx context.Context, userID string, c *Campaign, now time.Time) error {
+	if userID == "" {
+		return nil
+	}
+
+	for _, fc := range c.FrequencyCaps {
+		if fc.Period <= 0 {
+			continue
+		}
+
+		period := time.Duration(fc.Period) * time.Second
+		_, err := f.Store.Incr(ctx, f.Set, f.key(userID, c.ID, fc, now), "n", 1, period)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
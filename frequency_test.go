@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFrequencyCapper(t *testing.T) {
+	f := &FrequencyCapper{
+		Store: NewMemoryBidStore(),
+		Set:   "freq",
+	}
+
+	c := &Campaign{
+		ID:            "c1",
+		FrequencyCaps: []FrequencyCap{{Count: 3, Period: 86400}, {Count: 2, Period: 3600}},
+	}
+
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := f.Allow(ctx, "u1", c, now); !ok {
+			t.Fatalf("Allow() should allow impression #%d", i+1)
+		}
+		f.Record(ctx, "u1", c, now)
+	}
+
+	if ok, _ := f.Allow(ctx, "u1", c, now); ok {
+		t.Errorf("Allow() should reject by the hourly cap")
+	}
+
+	now = now.Add(time.Hour)
+	if ok, _ := f.Allow(ctx, "u1", c, now); !ok {
+		t.Errorf("Allow() should allow in the next hour")
+	}
+	f.Record(ctx, "u1", c, now)
+
+	if ok, _ := f.Allow(ctx, "u1", c, now); ok {
+		t.Errorf("Allow() should reject by the daily cap")
+	}
+
+	if ok, _ := f.Allow(ctx, "u2", c, now); !ok {
+		t.Errorf("Allow() should not share caps across users")
+	}
+	if ok, _ := f.Allow(ctx, "", c, now); ok {
+		t.Errorf("Allow() should reject an unknown user of a capped campaign")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/md5"
 	"crypto/tls"
+	"encoding/hex"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -206,6 +208,21 @@ func MinDuration(a, b time.Duration) time.Duration {
 	return b
 }
 
+// RandomHex returns n random bytes in hex.
+func RandomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// CeilSeconds returns d in whole seconds rounded up, as used by Retry-After.
+func CeilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
 func HasString(ss []string, s string) bool {
 	for _, v := range ss {
 		if v == s {
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"testing"
+	"time"
 )
 
 func TestJash3HashDummy(t *testing.T) {
@@ -27,3 +28,22 @@ func TestJash3HashTLS13(t *testing.T) {
 		t.Logf("Ja3Hash Chrome: %x", b)
 	}
 }
+
+func TestCeilSeconds(t *testing.T) {
+	var cases = []struct {
+		d time.Duration
+		n int
+	}{
+		{-time.Second, 0},
+		{0, 0},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+	}
+
+	for _, c := range cases {
+		if n := CeilSeconds(c.d); n != c.n {
+			t.Errorf("CeilSeconds(%v) return %d, not match %d", c.d, n, c.n)
+		}
+	}
+}
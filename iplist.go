@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/phuslu/glog"
+)
+
+// IPTree is a binary prefix tree of CIDRs, IPv4 networks are stored as IPv4
+// mapped IPv6 networks, so a lookup walks at most 128 nodes.
+type IPTree struct {
+	root ipTreeNode
+	size int
+}
+
+type ipTreeNode struct {
+	children [2]*ipTreeNode
+	tags     []string
+}
+
+func (t *IPTree) Insert(ipnet *net.IPNet, tag string) {
+	ip := ipnet.IP.To16()
+	ones, bits := ipnet.Mask.Size()
+	if ip == nil || bits == 0 {
+		return
+	}
+	if bits == 32 {
+		ones += 96
+	}
+
+	n := &t.root
+	for i := 0; i < ones; i++ {
+		b := (ip[i/8] >> uint(7-i%8)) & 1
+		if n.children[b] == nil {
+			n.children[b] = &ipTreeNode{}
+		}
+		n = n.children[b]
+	}
+
+	if !HasString(n.tags, tag) {
+		n.tags = append(n.tags, tag)
+		t.size++
+	}
+}
+
+// Lookup returns the tags of all networks containing ip.
+func (t *IPTree) Lookup(ip net.IP) (tags []string) {
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+
+	n := &t.root
+	for i := 0; n != nil; i++ {
+		for _, tag := range n.tags {
+			if !HasString(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		if i == 128 {
+			break
+		}
+		n = n.children[(ip[i/8]>>uint(7-i%8))&1]
+	}
+
+	return tags
+}
+
+// LookupLongest returns the tag of the longest prefix network containing ip,
+// the last inserted one if the network has several tags.
+func (t *IPTree) LookupLongest(ip net.IP) (tag string) {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+
+	n := &t.root
+	for i := 0; n != nil; i++ {
+		if len(n.tags) > 0 {
+			tag = n.tags[len(n.tags)-1]
+		}
+		if i == 128 {
+			break
+		}
+		n = n.children[(ip[i/8]>>uint(7-i%8))&1]
+	}
+
+	return tag
+}
+
+func (t *IPTree) Len() int {
+	return t.size
+}
+
+// AddList inserts every IP or CIDR of reader into t with tag, one per line,
+// text after '#' is a comment.
+func (t *IPTree) AddList(reader io.Reader, tag string) error {
+	scanner := bufio.NewScanner(reader)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		s := scanner.Text()
+		if pos := strings.Index(s, "#"); pos >= 0 {
+			s = s[:pos]
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		ipnet, err := ParseIPNet(s)
+		if err != nil {
+			return fmt.Errorf("line %d: %+v", lineno, err)
+		}
+
+		t.Insert(ipnet, tag)
+	}
+
+	return scanner.Err()
+}
+
+// ParseIPNet parses a CIDR, or a single IP as a host network.
+func ParseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %#v", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// see https://en.wikipedia.org/wiki/Reserved_IP_addresses
+var ReservedIPNets = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.88.99.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// PoisonousIPNets are the bogus answers of the GFW DNS poisoning.
+var PoisonousIPNets = []string{
+	"42.123.125.237",
+	"60.19.29.22",
+	"61.54.28.6",
+	"61.131.208.210",
+	"61.131.208.211",
+	"110.249.209.42",
+	"113.11.194.190",
+	"120.192.83.163",
+	"123.126.249.238",
+	"123.129.254.12",
+	"123.129.254.13",
+	"123.129.254.14",
+	"123.129.254.15",
+	"125.211.213.132",
+	"183.221.250.11",
+	"202.98.24.122",
+	"202.98.24.124",
+	"202.98.24.125",
+	"202.106.1.2",
+	"202.181.7.85",
+	"211.94.66.147",
+	"211.98.70.195",
+	"211.98.70.226",
+	"211.98.70.227",
+	"211.98.71.195",
+	"211.138.34.204",
+	"211.138.74.132",
+	"218.93.250.18",
+	"220.165.8.172",
+	"220.165.8.174",
+	"220.250.64.20",
+	"221.8.69.27",
+	"221.179.46.190",
+}
+
+// builtinIPTree holds the builtin "reserved" and "poisonous" lists, it is
+// used by IsReservedIP and by IPLists before the first Load.
+var builtinIPTree = newBuiltinIPTree()
+
+func newBuiltinIPTree() *IPTree {
+	tree := &IPTree{}
+	for _, s := range ReservedIPNets {
+		ipnet, _ := ParseIPNet(s)
+		tree.Insert(ipnet, "reserved")
+	}
+	for _, s := range PoisonousIPNets {
+		ipnet, _ := ParseIPNet(s)
+		tree.Insert(ipnet, "poisonous")
+	}
+	return tree
+}
+
+// IsReservedIP reports whether ip is in ReservedIPNets.
+func IsReservedIP(ip net.IP) bool {
+	return HasString(builtinIPTree.Lookup(ip), "reserved")
+}
+
+type IPListFile struct {
+	Tag  string
+	File string
+}
+
+// IPLists tags IPs by the lists loaded from Files, plus the builtin
+// "reserved" and "poisonous" lists. The lists are reloaded when any of the files changes.
+type IPLists struct {
+	Files []IPListFile
+
+	tree atomic.Value // *IPTree
+}
+
+func (l *IPLists) Load() error {
+	tree := newBuiltinIPTree()
+
+	for _, f := range l.Files {
+		file, err := os.Open(f.File)
+		if err != nil {
+			return err
+		}
+
+		err = tree.AddList(file, f.Tag)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("load iplist %#v from %#v error: %+v", f.Tag, f.File, err)
+		}
+	}
+
+	l.tree.Store(tree)
+
+	glog.Infos().Int("size", tree.Len()).Msg("iplists loaded")
+
+	return nil
+}
+
+func (l *IPLists) Lookup(ip net.IP) []string {
+	tree, _ := l.tree.Load().(*IPTree)
+	if tree == nil {
+		tree = builtinIPTree
+	}
+	return tree.Lookup(ip)
+}
+
+func (l *IPLists) Watcher() {
+	if len(l.Files) == 0 {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Fatals().Err(err).Msg("fsnotify.NewWatcher() error")
+	}
+	defer watcher.Close()
+
+	// watch the directories, editors and downloaders usually replace files by rename.
+	files := make(map[string]struct{})
+	for _, f := range l.Files {
+		filename, _ := filepath.Abs(f.File)
+		files[filename] = struct{}{}
+
+		dirname := filepath.Dir(filename)
+		if err := watcher.Add(dirname); err != nil {
+			glog.Errors().Err(err).Str("dirname", dirname).Msg("watcher.Add(...) error")
+		}
+	}
+
+	for {
+		select {
+		case event := <-watcher.Events:
+			if _, ok := files[event.Name]; !ok {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			glog.Infos().Str("event_name", event.Name).Msg("modified iplist file")
+			if err := l.Load(); err != nil {
+				glog.Errors().Err(err).Msg("reload iplists error")
+			}
+		case err := <-watcher.Errors:
+			glog.Errors().Err(err).Msg("watch iplist files error")
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIPTree(t *testing.T) {
+	tree := &IPTree{}
+
+	err := tree.AddList(strings.NewReader(`
+# comment
+1.2.3.0/24
+1.2.0.0/16 # proxy
+2001:db8::/32
+8.8.8.8
+`), "a")
+	if err != nil {
+		t.Fatalf("AddList() error: %+v", err)
+	}
+	tree.AddList(strings.NewReader("1.2.3.4\n"), "b")
+
+	var cases = []struct {
+		ip   string
+		tags []string
+	}{
+		{"1.2.3.4", []string{"a", "b"}},
+		{"1.2.4.4", []string{"a"}},
+		{"1.3.0.1", nil},
+		{"8.8.8.8", []string{"a"}},
+		{"8.8.4.4", nil},
+		{"2001:db8::1", []string{"a"}},
+		{"2001:db9::1", nil},
+	}
+
+	for _, c := range cases {
+		if tags := tree.Lookup(net.ParseIP(c.ip)); !reflect.DeepEqual(tags, c.tags) {
+			t.Errorf("Lookup(%#v) return %#v, not match %#v", c.ip, tags, c.tags)
+		}
+	}
+
+	if err := tree.AddList(strings.NewReader("1.2.3\n"), "c"); err == nil {
+		t.Errorf("AddList() should reject invalid ip")
+	}
+}
+
+func TestIPTreeLookupLongest(t *testing.T) {
+	tree := &IPTree{}
+	for _, r := range [][2]string{
+		{"10.0.0.0/8", "US-CA"},
+		{"10.1.0.0/16", "US-NY"},
+		{"10.1.2.0/24", "US-CA"},
+		{"2001:db8::/32", "DE"},
+		{"2001:db8:1::/48", "DE-BE"},
+	} {
+		ipnet, _ := ParseIPNet(r[0])
+		tree.Insert(ipnet, r[1])
+	}
+
+	var cases = [][2]string{
+		{"10.1.2.3", "US-CA"},
+		{"10.1.3.3", "US-NY"},
+		{"10.2.0.1", "US-CA"},
+		{"11.0.0.1", ""},
+		{"2001:db8:1::1", "DE-BE"},
+		{"2001:db8:2::1", "DE"},
+	}
+
+	for _, c := range cases {
+		if tag := tree.LookupLongest(net.ParseIP(c[0])); tag != c[1] {
+			t.Errorf("LookupLongest(%#v) return %#v, not match %#v", c[0], tag, c[1])
+		}
+	}
+}
+
+func TestIPLists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iplist")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "tor.txt")
+	ioutil.WriteFile(filename, []byte("185.220.101.0/24\n"), 0644)
+
+	l := &IPLists{
+		Files: []IPListFile{{Tag: "tor", File: filename}},
+	}
+	if err := l.Load(); err != nil {
+		t.Fatalf("Load() error: %+v", err)
+	}
+
+	if tags := l.Lookup(net.ParseIP("185.220.101.7")); !reflect.DeepEqual(tags, []string{"tor"}) {
+		t.Errorf("Lookup() return %#v", tags)
+	}
+	if tags := l.Lookup(net.ParseIP("192.168.1.1")); !reflect.DeepEqual(tags, []string{"reserved"}) {
+		t.Errorf("Lookup() return %#v", tags)
+	}
+	if tags := l.Lookup(net.ParseIP("61.54.28.6")); !reflect.DeepEqual(tags, []string{"poisonous"}) {
+		t.Errorf("Lookup() return %#v", tags)
+	}
+}
+
+func TestIsReservedIP(t *testing.T) {
+	var cases = []struct {
+		ip       string
+		reserved bool
+	}{
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.128.0.1", false},
+		{"172.31.255.255", true},
+		{"172.32.0.1", false},
+		{"192.0.2.1", true},
+		{"198.18.0.1", true},
+		{"224.0.0.1", true},
+		{"8.8.8.8", false},
+		{"::1", true},
+		{"fd00::1", true},
+		{"2001:4860::8888", false},
+	}
+
+	for _, c := range cases {
+		if v := IsReservedIP(net.ParseIP(c.ip)); v != c.reserved {
+			t.Errorf("IsReservedIP(%#v) return %v, not match %v", c.ip, v, c.reserved)
+		}
+	}
+}
@@ -14,7 +14,7 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/aerospike/aerospike-client-go"
+	"github.com/alecthomas/geoip"
 	"github.com/buaazp/fasthttprouter"
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/json-iterator/go"
@@ -83,37 +83,255 @@ func main() {
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
 		DisableCompression:    false,
 		Proxy:                 http.ProxyFromEnvironment,
 	}
 
+	limiterCapacity := 100000
+	if config.Ipinfo.LimiterCapacity > 0 {
+		limiterCapacity = config.Ipinfo.LimiterCapacity
+	}
+
+	limiterTTL := 10 * time.Minute
+	if config.Ipinfo.LimiterTtl > 0 {
+		limiterTTL = time.Duration(config.Ipinfo.LimiterTtl) * time.Second
+	}
+
+	var ratelimiter RateLimiter
+	switch config.Ipinfo.RatelimitBackend {
+	case "", "local":
+		ratelimiter = &LocalRateLimiter{
+			Cache: lrucache.NewLRUCache(uint(limiterCapacity)),
+			TTL:   limiterTTL,
+		}
+	case "redis":
+		ratelimiter = &RedisRateLimiter{
+			Addr:     config.Ipinfo.RatelimitRedisAddr,
+			Password: config.Ipinfo.RatelimitRedisPassword,
+			Prefix:   "apiserver:ratelimit:",
+			Timeout:  100 * time.Millisecond,
+			MaxIdle:  64,
+		}
+	default:
+		glog.Fatals().Str("ratelimit_backend", config.Ipinfo.RatelimitBackend).Msg("unsupported ratelimit backend")
+	}
+
+	ipinfoTimeout := 5 * time.Second
+	if config.Ipinfo.Timeout > 0 {
+		ipinfoTimeout = time.Duration(config.Ipinfo.Timeout) * time.Second
+	}
+
+	ipinfoMaxBodySize := int64(1 << 20)
+	if config.Ipinfo.MaxBodySize > 0 {
+		ipinfoMaxBodySize = int64(config.Ipinfo.MaxBodySize)
+	}
+
+	breaker := &CircuitBreaker{
+		FailureThreshold: 5,
+		SlowThreshold:    time.Duration(config.Ipinfo.BreakerSlow) * time.Second,
+		OpenTimeout:      30 * time.Second,
+	}
+	if config.Ipinfo.BreakerFailures > 0 {
+		breaker.FailureThreshold = config.Ipinfo.BreakerFailures
+	}
+	if config.Ipinfo.BreakerOpenTimeout > 0 {
+		breaker.OpenTimeout = time.Duration(config.Ipinfo.BreakerOpenTimeout) * time.Second
+	}
+
+	iplists := &IPLists{
+		Files: config.Ipinfo.Iplist,
+	}
+	if err := iplists.Load(); err != nil {
+		glog.Fatals().Err(err).Msg("iplists.Load() error")
+	}
+	go iplists.Watcher()
+
 	ipinfo := &IpinfoHandler{
 		URL:          config.Ipinfo.Url,
 		Regex:        regexp.MustCompile(config.Ipinfo.Regex),
+		Charset:      config.Ipinfo.Charset,
 		CacheTTL:     time.Duration(config.Ipinfo.CacheTtl) * time.Second,
 		Cache:        lrucache.NewLRUCache(10000),
 		Singleflight: &singleflight.Group{},
 		Transport:    transport,
+		Resolver:     dialer.Resolver,
+		IPLists:      iplists,
+		Timeout:      ipinfoTimeout,
+		MaxBodySize:  ipinfoMaxBodySize,
+		Breaker:      breaker,
 		RateLimit:    config.Ipinfo.Ratelimit,
+		RateLimiter:  ratelimiter,
 		Config:       config,
 	}
 
-	asClient, err := aerospike.NewClient(config.Bid.AerospikeHost, config.Bid.AerospikePort)
-	if err != nil {
-		// glog.Fatals().Err(err).Str("aerospike_host", config.Bid.AerospikeHost).Int("aerospike_port", config.Bid.AerospikePort).Msg("aerospike.NewClient(..) error")
+	var store BidStore
+	switch config.Bid.Store {
+	case "memory":
+		store = NewMemoryBidStore()
+	case "", "aerospike":
+		asStore := &AerospikeBidStore{
+			Config: config,
+		}
+		go asStore.Watcher()
+		store = asStore
+	default:
+		glog.Fatals().Str("store", config.Bid.Store).Msg("unsupported bid store")
+	}
+
+	campaigns := &CampaignCatalog{
+		File:  config.Bid.CampaignFile,
+		Store: store,
+		Set:   config.Bid.CampaignSet,
+	}
+	if err := campaigns.Load(); err != nil {
+		glog.Errors().Err(err).Str("campaign_file", config.Bid.CampaignFile).Msg("campaigns.Load() error")
+	}
+	go campaigns.Watcher()
+
+	region := &RegionResolver{
+		Resolver: dialer.Resolver,
+		IPLists:  iplists,
+		Cache:    lrucache.NewLRUCache(100000),
+	}
+	if config.Bid.GeoipFile != "" {
+		region.Regions, err = LoadRegionTree(config.Bid.GeoipFile)
+		if err != nil {
+			glog.Fatals().Err(err).Str("geoip_file", config.Bid.GeoipFile).Msg("LoadRegionTree(...) error")
+		}
+	} else {
+		region.GeoIP, err = geoip.New()
+		if err != nil {
+			glog.Fatals().Err(err).Msg("geoip.New() error")
+		}
+	}
+
+	frequency := &FrequencyCapper{
+		Store: store,
+		Set:   config.Bid.FrequencySet,
+	}
+
+	spendCacheTTL := time.Duration(config.Bid.SpendCacheTtl) * time.Second
+	if spendCacheTTL == 0 {
+		spendCacheTTL = time.Second
+	}
+
+	pacer := &BudgetPacer{
+		Store:    store,
+		Set:      config.Bid.SpendSet,
+		Cache:    lrucache.NewLRUCache(10000),
+		CacheTTL: spendCacheTTL,
+	}
+
+	winrateWindow := time.Duration(config.Bid.WinrateWindow) * time.Hour
+	if winrateWindow == 0 {
+		winrateWindow = 6 * time.Hour
+	}
+
+	winrate := &WinRateTracker{
+		Store:    store,
+		Set:      config.Bid.WinrateSet,
+		Window:   winrateWindow,
+		Cache:    lrucache.NewLRUCache(100000),
+		CacheTTL: time.Minute,
+	}
+
+	exchanges := make(map[string]*Exchange)
+	for _, c := range config.Bid.Exchange {
+		exchanges[c.Name], err = NewExchange(c)
+		if err != nil {
+			glog.Fatals().Err(err).Str("exchange", c.Name).Msg("NewExchange(...) error")
+		}
+	}
+
+	var bidlog *BidLogger
+	if config.Bid.BidlogDir != "" {
+		bidlog = &BidLogger{
+			Dir:       config.Bid.BidlogDir,
+			MaxSize:   int64(config.Bid.BidlogMaxSize) << 20,
+			MaxAge:    time.Duration(config.Bid.BidlogMaxAge) * time.Second,
+			QueueSize: config.Bid.BidlogQueueSize,
+			Sampling:  config.Bid.BidlogSampling,
+		}
+		if bidlog.MaxSize == 0 {
+			bidlog.MaxSize = 100 << 20
+		}
+		if bidlog.MaxAge == 0 {
+			bidlog.MaxAge = 10 * time.Minute
+		}
+		if bidlog.QueueSize == 0 {
+			bidlog.QueueSize = 10000
+		}
+		if err := bidlog.Start(); err != nil {
+			glog.Fatals().Err(err).Str("bidlog_dir", config.Bid.BidlogDir).Msg("bidlog.Start() error")
+		}
 	}
 
 	bidder := &BidHandler{
-		AeroSpike: asClient,
+		Store:     store,
+		Campaigns: campaigns,
+		Region:    region,
+		Frequency: frequency,
+		Pacer:     pacer,
+		WinRate:   winrate,
+		Exchanges: exchanges,
+		BidLog:    bidlog,
 		Config:    config,
 	}
 
+	decrypters := make(map[string]PriceDecrypter)
+	for _, k := range config.Bid.PriceKey {
+		decrypters[k.Exchange], err = NewPriceDecrypter(k)
+		if err != nil {
+			glog.Fatals().Err(err).Str("exchange", k.Exchange).Msg("NewPriceDecrypter(...) error")
+		}
+	}
+
+	if config.Bid.NoticeSecret == "" {
+		glog.Warnings().Msg("bid.notice_secret is empty, all notices will be rejected")
+	}
+
+	notice := &NoticeHandler{
+		Store:      store,
+		Campaigns:  campaigns,
+		Exchanges:  exchanges,
+		Frequency:  frequency,
+		Pacer:      pacer,
+		WinRate:    winrate,
+		Decrypters: decrypters,
+		BidLog:     bidlog,
+		Config:     config,
+	}
+
+	index := &IndexHandler{
+		Ipinfo: ipinfo,
+	}
+
+	metrics := &MetricsHandler{
+		Ipinfo: ipinfo,
+		Bidder: bidder,
+		Notice: notice,
+	}
+
 	router := fasthttprouter.New()
-	router.GET("/", Index)
-	router.GET("/metrics", Metrics)
+	router.NotFound = NotFound
+	router.MethodNotAllowed = MethodNotAllowed
+	router.PanicHandler = PanicHandler
+	router.GET("/", index.Index)
+	router.GET("/metrics", metrics.Metrics)
+	router.GET("/health", bidder.Health)
 	router.GET("/debug/pprof/*profile", Pprof)
 	router.POST("/ipinfo", ipinfo.Ipinfo)
+	router.GET("/ipinfo", ipinfo.IpinfoGet)
+	router.GET("/ipinfo/:ip", ipinfo.IpinfoGet)
 	router.POST("/bid", bidder.Bid)
+	router.POST("/bid/:exchange", bidder.Bid)
+	router.GET("/win", notice.Win)
+	router.GET("/loss", notice.Loss)
+	router.GET("/bill", notice.Bill)
+	router.GET("/imp", notice.Imp)
+	router.GET("/click", notice.Click)
+	router.GET("/admin/spend", WithAdminToken(config.Default.AdminToken, notice.Spend))
 
 	an := Announcer{
 		FastOpen:    config.Default.TcpFastopen,
@@ -127,7 +345,7 @@ func main() {
 	}
 
 	server := &fasthttp.Server{
-		Handler: router.Handler,
+		Handler: WithRequestID(router.Handler),
 		Name:    "apiserver",
 	}
 
@@ -148,6 +366,7 @@ func main() {
 	switch <-c {
 	case syscall.SIGTERM, syscall.SIGINT:
 		glog.Infos().Msg("apiserver flush logs and exit.")
+		bidlog.Close()
 		glog.Flush()
 		os.Exit(0)
 	}
@@ -176,5 +395,6 @@ func main() {
 	wg.Wait()
 
 	glog.Infos().Msg("apiserver server shutdown")
+	bidlog.Close()
 	glog.Flush()
 }
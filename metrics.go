@@ -19,7 +19,13 @@ var (
 	MetricsFooCounter sync.Map // map[MetricsFooKey]*int64
 )
 
-func Metrics(ctx *fasthttp.RequestCtx) {
+type MetricsHandler struct {
+	Ipinfo *IpinfoHandler
+	Bidder *BidHandler
+	Notice *NoticeHandler
+}
+
+func (h *MetricsHandler) Metrics(ctx *fasthttp.RequestCtx) {
 	var w io.Writer = ctx
 	if ctx.Request.Header.HasAcceptEncoding("gzip") {
 		gz := gzip.NewWriter(ctx)
@@ -39,4 +45,56 @@ func Metrics(ctx *fasthttp.RequestCtx) {
 		fmt.Fprintf(w, "apiserver_foo_count{key1=\"%s\",key2=\"%s\"} %d\n", k.Key1, k.Key2, v)
 		return true
 	})
+
+	if l, ok := h.Ipinfo.RateLimiter.(*LocalRateLimiter); ok {
+		io.WriteString(w, "# HELP apiserver_ipinfo_limiters active ipinfo rate limiters\n")
+		io.WriteString(w, "# TYPE apiserver_ipinfo_limiters gauge\n")
+		fmt.Fprintf(w, "apiserver_ipinfo_limiters %d\n", l.Len())
+	}
+
+	provider := h.Ipinfo.Provider()
+	io.WriteString(w, "# HELP apiserver_ipinfo_breaker_state ipinfo upstream circuit breaker state, 0=closed 1=open 2=half-open\n")
+	io.WriteString(w, "# TYPE apiserver_ipinfo_breaker_state gauge\n")
+	fmt.Fprintf(w, "apiserver_ipinfo_breaker_state{provider=\"%s\"} %d\n", provider, h.Ipinfo.Breaker.State())
+	io.WriteString(w, "# HELP apiserver_ipinfo_breaker_failures ipinfo upstream consecutive failures\n")
+	io.WriteString(w, "# TYPE apiserver_ipinfo_breaker_failures gauge\n")
+	fmt.Fprintf(w, "apiserver_ipinfo_breaker_failures{provider=\"%s\"} %d\n", provider, h.Ipinfo.Breaker.Failures())
+
+	health := h.Bidder.Store.Health()
+	connected := 0
+	if health.Connected {
+		connected = 1
+	}
+	io.WriteString(w, "# HELP apiserver_bid_store_connected bid store connection state\n")
+	io.WriteString(w, "# TYPE apiserver_bid_store_connected gauge\n")
+	fmt.Fprintf(w, "apiserver_bid_store_connected{backend=\"%s\"} %d\n", health.Backend, connected)
+	io.WriteString(w, "# HELP apiserver_bid_store_nodes bid store cluster nodes\n")
+	io.WriteString(w, "# TYPE apiserver_bid_store_nodes gauge\n")
+	fmt.Fprintf(w, "apiserver_bid_store_nodes{backend=\"%s\"} %d\n", health.Backend, health.Nodes)
+
+	io.WriteString(w, "# HELP apiserver_bid_deadline_misses no-bids for an exceeded bid deadline\n")
+	io.WriteString(w, "# TYPE apiserver_bid_deadline_misses counter\n")
+	for stage, n := range h.Bidder.DeadlineMisses() {
+		fmt.Fprintf(w, "apiserver_bid_deadline_misses{stage=\"%s\"} %d\n", stage, n)
+	}
+
+	io.WriteString(w, "# HELP apiserver_bidlog_written bid log records written\n")
+	io.WriteString(w, "# TYPE apiserver_bidlog_written counter\n")
+	fmt.Fprintf(w, "apiserver_bidlog_written %d\n", h.Bidder.BidLog.Written())
+	io.WriteString(w, "# HELP apiserver_bidlog_dropped bid log records dropped\n")
+	io.WriteString(w, "# TYPE apiserver_bidlog_dropped counter\n")
+	fmt.Fprintf(w, "apiserver_bidlog_dropped %d\n", h.Bidder.BidLog.Dropped())
+
+	counts := h.Notice.Counts()
+	io.WriteString(w, "# HELP apiserver_bid_notices bid notices served\n")
+	io.WriteString(w, "# TYPE apiserver_bid_notices counter\n")
+	fmt.Fprintf(w, "apiserver_bid_notices{type=\"win\"} %d\n", counts.Win)
+	fmt.Fprintf(w, "apiserver_bid_notices{type=\"loss\"} %d\n", counts.Loss)
+	fmt.Fprintf(w, "apiserver_bid_notices{type=\"bill\"} %d\n", counts.Bill)
+	io.WriteString(w, "# HELP apiserver_bid_notice_duplicates duplicate bid notices dropped\n")
+	io.WriteString(w, "# TYPE apiserver_bid_notice_duplicates counter\n")
+	fmt.Fprintf(w, "apiserver_bid_notice_duplicates %d\n", counts.Duplicate)
+	io.WriteString(w, "# HELP apiserver_bid_notice_replays bid notices rejected for a replayed price\n")
+	io.WriteString(w, "# TYPE apiserver_bid_notice_replays counter\n")
+	fmt.Fprintf(w, "apiserver_bid_notice_replays %d\n", counts.Replay)
 }
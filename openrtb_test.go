@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBidRequestValidate(t *testing.T) {
+	var cases = []struct {
+		body  string
+		valid bool
+	}{
+		{`{"id":"1","imp":[{"id":"1","banner":{"w":300,"h":250}}],"site":{"domain":"example.com"}}`, true},
+		{`{"id":"1","imp":[{"id":"1","video":{"mimes":["video/mp4"]}}],"app":{"bundle":"com.example"}}`, true},
+		{`{"imp":[{"id":"1","banner":{}}]}`, false},
+		{`{"id":"1","imp":[]}`, false},
+		{`{"id":"1","imp":[{"id":"1"}]}`, false},
+		{`{"id":"1","imp":[{"id":"1","banner":{}},{"id":"1","banner":{}}]}`, false},
+		{`{"id":"1","imp":[{"id":"1","banner":{}}],"site":{},"app":{}}`, false},
+		{`{"id":"1","imp":[{"id":"1","video":{}}]}`, false},
+		{`{"id":"1","imp":[{"id":"1","banner":{},"bidfloor":-1}]}`, false},
+		{`{"id":"1","imp":[{"id":"1","banner":{},"pmp":{"deals":[{"bidfloor":1}]}}]}`, false},
+	}
+
+	for _, c := range cases {
+		var req BidRequest
+		if err := json.Unmarshal([]byte(c.body), &req); err != nil {
+			t.Fatalf("json.Unmarshal(%s) error: %+v", c.body, err)
+		}
+		if err := req.Validate(); (err == nil) != c.valid {
+			t.Errorf("Validate(%s) return %v", c.body, err)
+		}
+	}
+}
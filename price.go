@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrPriceMacro     = errors.New("price macro is not substituted")
+	ErrPriceIntegrity = errors.New("price integrity check failed")
+)
+
+// PriceDecrypter decodes the clearing price, in CPM, an exchange substitutes
+// for the ${AUCTION_PRICE} macro. The nonce identifies an encrypted price to
+// reject replays, it is empty for prices sent in clear.
+type PriceDecrypter interface {
+	DecryptPrice(s string) (price float64, nonce string, err error)
+}
+
+// PriceKey configures the price decrypter of an exchange. Scheme is "plain"
+// for prices sent in clear, "google" with web-safe base64 keys, or "openx"
+// with hex keys. It must be set, prices are never taken in clear by default.
+type PriceKey struct {
+	Exchange      string
+	Scheme        string
+	EncryptionKey string
+	IntegrityKey  string
+}
+
+// NewPriceDecrypter returns the price decrypter of k.
+func NewPriceDecrypter(k PriceKey) (PriceDecrypter, error) {
+	var decode func(string) ([]byte, error)
+	switch k.Scheme {
+	case "plain":
+		return PlainPriceDecrypter{}, nil
+	case "google":
+		decode = decodeWebSafeBase64
+	case "openx":
+		decode = hex.DecodeString
+	default:
+		return nil, fmt.Errorf("unsupported price scheme %#v of exchange %#v", k.Scheme, k.Exchange)
+	}
+
+	ekey, err := decode(k.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key of exchange %#v: %+v", k.Exchange, err)
+	}
+
+	ikey, err := decode(k.IntegrityKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid integrity key of exchange %#v: %+v", k.Exchange, err)
+	}
+
+	return &HMACPriceDecrypter{EncryptionKey: ekey, IntegrityKey: ikey}, nil
+}
+
+// PlainPriceDecrypter accepts clearing prices sent in clear.
+type PlainPriceDecrypter struct{}
+
+func (PlainPriceDecrypter) DecryptPrice(s string) (float64, string, error) {
+	if s == "" || strings.HasPrefix(s, "${") {
+		return 0, "", ErrPriceMacro
+	}
+
+	price, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	if price < 0 {
+		return 0, "", errors.New("negative price " + s)
+	}
+
+	return price, "", nil
+}
+
+// HMACPriceDecrypter decrypts the web-safe base64 of iv(16) + price(8) +
+// signature(4) used by Google and OpenX, where price is the big endian CPM
+// micros xor HMAC-SHA1(EncryptionKey, iv), and signature is the prefix of
+// HMAC-SHA1(IntegrityKey, price + iv). The iv is the nonce.
+type HMACPriceDecrypter struct {
+	EncryptionKey []byte
+	IntegrityKey  []byte
+}
+
+func (d *HMACPriceDecrypter) DecryptPrice(s string) (float64, string, error) {
+	if s == "" || strings.HasPrefix(s, "${") {
+		return 0, "", ErrPriceMacro
+	}
+
+	data, err := decodeWebSafeBase64(s)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(data) != 28 {
+		return 0, "", fmt.Errorf("invalid encrypted price length %d", len(data))
+	}
+
+	iv, price, sig := data[:16], make([]byte, 8), data[24:]
+
+	mac := hmac.New(sha1.New, d.EncryptionKey)
+	mac.Write(iv)
+	pad := mac.Sum(nil)
+	for i := range price {
+		price[i] = data[16+i] ^ pad[i]
+	}
+
+	mac = hmac.New(sha1.New, d.IntegrityKey)
+	mac.Write(price)
+	mac.Write(iv)
+	if !hmac.Equal(mac.Sum(nil)[:4], sig) {
+		return 0, "", ErrPriceIntegrity
+	}
+
+	micros := binary.BigEndian.Uint64(price)
+
+	return float64(micros) / 1e6, hex.EncodeToString(iv), nil
+}
+
+func decodeWebSafeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPlainPriceDecrypter(t *testing.T) {
+	cases := []struct {
+		Price string
+		Value float64
+		Error bool
+	}{
+		{"1.25", 1.25, false},
+		{"0", 0, false},
+		{"${AUCTION_PRICE}", 0, true},
+		{"", 0, true},
+		{"-1", 0, true},
+		{"abc", 0, true},
+	}
+
+	for _, c := range cases {
+		value, _, err := PlainPriceDecrypter{}.DecryptPrice(c.Price)
+		if value != c.Value || (err != nil) != c.Error {
+			t.Errorf("DecryptPrice(%#v) return %#v, %v, not match %#v", c.Price, value, err, c.Value)
+		}
+	}
+}
+
+func TestHMACPriceDecrypter(t *testing.T) {
+	// test vectors of the google ad exchange price decryption guide
+	d, err := NewPriceDecrypter(PriceKey{
+		Exchange:      "google",
+		Scheme:        "google",
+		EncryptionKey: "skU7Ax_NL5pPAFyKdkfZjZz2-VhIN8bjj1rVFOaJ_5o=",
+		IntegrityKey:  "arO23ykdNqUQ5LEoQ0FVmPkBd7xB5CO89PDZlSjpFxo=",
+	})
+	if err != nil {
+		t.Fatalf("NewPriceDecrypter() error: %+v", err)
+	}
+
+	cases := []struct {
+		Price string
+		Value float64
+		Error bool
+	}{
+		{"YWJjMTIzZGVmNDU2Z2hpN7fhCuPemCce_6msaw", 0.0001, false},
+		{"YWJjMTIzZGVmNDU2Z2hpN7fhCuPemCAWJRxOgA", 0.0019, false},
+		{"YWJjMTIzZGVmNDU2Z2hpN7fhCuPemC32prpWWw", 0.0027, false},
+		// tampered signature and price
+		{"YWJjMTIzZGVmNDU2Z2hpN7fhCuPemC32prpWAA", 0, true},
+		{"YWJjMTIzZGVmNDU2Z2hpN7fhCuPemD32prpWWw", 0, true},
+		{"YWJjMTIzZGVmNDU2Z2hp", 0, true},
+		{"${AUCTION_PRICE}", 0, true},
+	}
+
+	for _, c := range cases {
+		value, nonce, err := d.DecryptPrice(c.Price)
+		if value != c.Value || (err != nil) != c.Error {
+			t.Errorf("DecryptPrice(%#v) return %#v, %v, not match %#v", c.Price, value, err, c.Value)
+		}
+		if err == nil && nonce != "61626331323364656634353667686937" {
+			t.Errorf("DecryptPrice(%#v) return nonce %#v, not match the iv", c.Price, nonce)
+		}
+	}
+}
+
+func TestNewPriceDecrypter(t *testing.T) {
+	cases := []struct {
+		Scheme string
+		Error  bool
+	}{
+		{"plain", false},
+		{"", true},
+		{"rot13", true},
+	}
+
+	for _, c := range cases {
+		if _, err := NewPriceDecrypter(PriceKey{Exchange: "x1", Scheme: c.Scheme}); (err != nil) != c.Error {
+			t.Errorf("NewPriceDecrypter(%#v) return %v", c.Scheme, err)
+		}
+	}
+}
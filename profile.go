@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Profile is the audience data of a user, stored as a record of the
+// [bid] profile_set with the bins "segments", "last_seen" and "imps".
+type Profile struct {
+	ID          string
+	Segments    []string
+	LastSeen    time.Time
+	Impressions int64
+}
+
+// Recency returns the duration since the user was seen last time, or -1 if
+// the user is never seen.
+func (p *Profile) Recency() time.Duration {
+	if p.LastSeen.IsZero() {
+		return -1
+	}
+	return time.Since(p.LastSeen)
+}
+
+func (p *Profile) HasSegment(segment string) bool {
+	return HasString(p.Segments, segment)
+}
+
+// UserID returns the id to look up the profile of req, the exchange user id
+// takes precedence over the buyer uid and the device advertising id.
+func UserID(req *BidRequest) string {
+	if req.User != nil {
+		if req.User.ID != "" {
+			return req.User.ID
+		}
+		if req.User.BuyerUID != "" {
+			return req.User.BuyerUID
+		}
+	}
+	if req.Device != nil && req.Device.IFA != "" {
+		return req.Device.IFA
+	}
+	return ""
+}
+
+// LoadProfile reads the profile of id from set, a missing record returns an
+// empty profile.
+func LoadProfile(ctx context.Context, store BidStore, set, id string) (*Profile, error) {
+	p := &Profile{ID: id}
+	if id == "" {
+		return p, nil
+	}
+
+	bins, err := store.Get(ctx, set, id)
+	if err != nil {
+		return p, err
+	}
+
+	p.Segments = ToStrings(bins["segments"])
+	if ts := ToInt64(bins["last_seen"]); ts > 0 {
+		p.LastSeen = time.Unix(ts, 0)
+	}
+	p.Impressions = ToInt64(bins["imps"])
+
+	return p, nil
+}
+
+// ToStrings converts a list or comma separated bin value to []string.
+func ToStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	case string:
+		if v == "" {
+			return nil
+		}
+		return strings.Split(v, ",")
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadProfile(t *testing.T) {
+	store := NewMemoryBidStore()
+	ctx := context.Background()
+
+	store.Put(ctx, "profile", "u1", map[string]interface{}{
+		"segments":  []interface{}{"sports", "auto"},
+		"last_seen": time.Now().Add(-time.Hour).Unix(),
+		"imps":      7,
+	}, 0)
+
+	p, err := LoadProfile(ctx, store, "profile", "u1")
+	if err != nil {
+		t.Fatalf("LoadProfile() error: %+v", err)
+	}
+	if !reflect.DeepEqual(p.Segments, []string{"sports", "auto"}) || p.Impressions != 7 {
+		t.Errorf("LoadProfile() return %+v", p)
+	}
+	if r := p.Recency(); r < time.Hour || r > time.Hour+time.Minute {
+		t.Errorf("Recency() return %v", r)
+	}
+
+	p, _ = LoadProfile(ctx, store, "profile", "u2")
+	if p.Recency() != -1 || len(p.Segments) != 0 {
+		t.Errorf("LoadProfile() of a missing user return %+v", p)
+	}
+}
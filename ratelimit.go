@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"golang.org/x/time/rate"
+)
+
+type RateLimitStatus struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimiter allows at most limit requests per second for each key.
+type RateLimiter interface {
+	Allow(key string, limit int) (RateLimitStatus, error)
+}
+
+// LocalRateLimiter keeps a token bucket per key in process memory, an idle
+// bucket is evicted after TTL and the least recently used one is evicted when
+// Cache is full.
+type LocalRateLimiter struct {
+	Cache lrucache.Cache
+	TTL   time.Duration
+
+	mu sync.Mutex
+}
+
+func (l *LocalRateLimiter) Allow(key string, limit int) (RateLimitStatus, error) {
+	limiter := l.limiter(key, limit)
+
+	status := RateLimitStatus{
+		Allowed: true,
+		Limit:   limit,
+	}
+
+	r := limiter.Reserve()
+	switch {
+	case !r.OK():
+		status.Allowed = false
+		status.RetryAfter = time.Second
+	case r.Delay() > 0:
+		status.Allowed = false
+		status.RetryAfter = r.Delay()
+		r.Cancel()
+	}
+
+	tokens := limiter.Tokens()
+	if tokens > 0 {
+		status.Remaining = int(tokens)
+	}
+	if limit > 0 {
+		status.Reset = time.Duration((float64(limit) - tokens) / float64(limit) * float64(time.Second))
+	}
+
+	return status, nil
+}
+
+func (l *LocalRateLimiter) Len() int {
+	return l.Cache.Len()
+}
+
+func (l *LocalRateLimiter) limiter(key string, limit int) *rate.Limiter {
+	// get or create under lock, or concurrent first requests of key would
+	// each get a bucket of their own
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var limiter *rate.Limiter
+	if v, ok := l.Cache.GetNotStale(key); ok {
+		limiter = v.(*rate.Limiter)
+		if limiter.Burst() != limit {
+			limiter.SetLimit(rate.Limit(limit))
+			limiter.SetBurst(limit)
+		}
+	} else {
+		limiter = rate.NewLimiter(rate.Limit(limit), limit)
+	}
+
+	l.Cache.Set(key, limiter, time.Now().Add(l.TTL))
+
+	return limiter
+}
+
+// RedisRateLimiter shares a sliding window counter per key in a redis
+// protocol server, so that several apiserver instances enforce one quota.
+// Rejected requests are counted as well, a client keeps being rejected until
+// it slows down below the limit.
+type RedisRateLimiter struct {
+	Addr     string
+	Password string
+	Prefix   string
+	Timeout  time.Duration
+	MaxIdle  int
+
+	mu    sync.Mutex
+	conns []*redisConn
+}
+
+func (l *RedisRateLimiter) Allow(key string, limit int) (RateLimitStatus, error) {
+	const window = time.Second
+
+	now := time.Now().UnixNano()
+	current := now / int64(window)
+	elapsed := time.Duration(now - current*int64(window))
+
+	curKey := l.Prefix + key + ":" + strconv.FormatInt(current, 10)
+	prevKey := l.Prefix + key + ":" + strconv.FormatInt(current-1, 10)
+
+	replies, err := l.do(
+		[]string{"INCR", curKey},
+		[]string{"PEXPIRE", curKey, strconv.FormatInt(int64(2*window/time.Millisecond), 10)},
+		[]string{"GET", prevKey},
+	)
+	if err != nil {
+		return RateLimitStatus{Allowed: true, Limit: limit, Remaining: limit}, err
+	}
+
+	curCount, _ := replies[0].(int64)
+	prevCount := int64(0)
+	if b, ok := replies[2].([]byte); ok {
+		prevCount, _ = strconv.ParseInt(string(b), 10, 64)
+	}
+
+	count := float64(prevCount)*float64(window-elapsed)/float64(window) + float64(curCount)
+
+	status := RateLimitStatus{
+		Allowed: count <= float64(limit),
+		Limit:   limit,
+		Reset:   window - elapsed,
+	}
+	if remaining := float64(limit) - math.Ceil(count); remaining > 0 {
+		status.Remaining = int(remaining)
+	}
+	if !status.Allowed {
+		status.RetryAfter = status.Reset
+	}
+
+	return status, nil
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+var errRedisNil = errors.New("redis: nil")
+
+// do pipelines cmds in one round trip and returns a reply per command,
+// an integer reply is int64, a bulk reply is []byte and a nil reply is nil.
+func (l *RedisRateLimiter) do(cmds ...[]string) ([]interface{}, error) {
+	c, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Timeout > 0 {
+		c.SetDeadline(time.Now().Add(l.Timeout))
+	}
+
+	buf := make([]byte, 0, 256)
+	for _, cmd := range cmds {
+		buf = appendRedisCommand(buf, cmd)
+	}
+
+	if _, err = c.Write(buf); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		replies[i], err = readRedisReply(c.r)
+		if err == errRedisNil {
+			err = nil
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	l.put(c)
+
+	return replies, nil
+}
+
+func (l *RedisRateLimiter) get() (*redisConn, error) {
+	l.mu.Lock()
+	if n := len(l.conns); n > 0 {
+		c := l.conns[n-1]
+		l.conns = l.conns[:n-1]
+		l.mu.Unlock()
+		return c, nil
+	}
+	l.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", l.Addr, l.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn, bufio.NewReader(conn)}
+
+	if l.Password != "" {
+		if l.Timeout > 0 {
+			c.SetDeadline(time.Now().Add(l.Timeout))
+		}
+		if _, err = c.Write(appendRedisCommand(nil, []string{"AUTH", l.Password})); err == nil {
+			_, err = readRedisReply(c.r)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (l *RedisRateLimiter) put(c *redisConn) {
+	c.SetDeadline(time.Time{})
+
+	l.mu.Lock()
+	if len(l.conns) < l.MaxIdle {
+		l.conns = append(l.conns, c)
+		c = nil
+	}
+	l.mu.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+}
+
+func appendRedisCommand(buf []byte, args []string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, errors.New("redis: " + string(line[1:]))
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = readRedisReply(r)
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+func TestLocalRateLimiter(t *testing.T) {
+	l := &LocalRateLimiter{
+		Cache: lrucache.NewLRUCache(2),
+		TTL:   time.Minute,
+	}
+
+	if s, _ := l.Allow("a", 1); !s.Allowed {
+		t.Errorf("Allow(%#v) should allow the first request", "a")
+	}
+	if s, _ := l.Allow("a", 1); s.Allowed || s.RetryAfter <= 0 {
+		t.Errorf("Allow(%#v) should reject the second request, got %+v", "a", s)
+	}
+
+	l.Allow("b", 1)
+	l.Allow("c", 1)
+	if n := l.Len(); n != 2 {
+		t.Errorf("Len() return %d, not match %d", n, 2)
+	}
+
+	l.TTL = -time.Second
+	l.Allow("d", 1)
+	if s, _ := l.Allow("d", 1); !s.Allowed {
+		t.Errorf("Allow(%#v) should evict the idle limiter", "d")
+	}
+}
+
+func TestLocalRateLimiterConcurrent(t *testing.T) {
+	l := &LocalRateLimiter{
+		Cache: lrucache.NewLRUCache(100),
+		TTL:   time.Minute,
+	}
+
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s, _ := l.Allow("a", 1); s.Allowed {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 1 {
+		t.Errorf("Allow(%#v) allowed %d concurrent first requests, not match 1", "a", allowed)
+	}
+}
+
+// fakeRedis is a local stand-in of a redis server which serves INCR, PEXPIRE and GET.
+type fakeRedis struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+func (f *fakeRedis) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				v, err := readRedisReply(r)
+				if err != nil {
+					return
+				}
+				args := v.([]interface{})
+				key := string(args[1].([]byte))
+
+				f.mu.Lock()
+				var reply string
+				switch string(args[0].([]byte)) {
+				case "INCR":
+					f.m[key]++
+					reply = ":" + strconv.FormatInt(f.m[key], 10) + "\r\n"
+				case "PEXPIRE":
+					reply = ":1\r\n"
+				case "GET":
+					if n, ok := f.m[key]; ok {
+						s := strconv.FormatInt(n, 10)
+						reply = "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+					} else {
+						reply = "$-1\r\n"
+					}
+				default:
+					reply = "-ERR unknown command\r\n"
+				}
+				f.mu.Unlock()
+
+				conn.Write([]byte(reply))
+			}
+		}(conn)
+	}
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error: %+v", err)
+	}
+	defer ln.Close()
+
+	go (&fakeRedis{m: make(map[string]int64)}).serve(ln)
+
+	l := &RedisRateLimiter{
+		Addr:    ln.Addr().String(),
+		Prefix:  "test:",
+		Timeout: time.Second,
+		MaxIdle: 2,
+	}
+
+	// align to the beginning of a window, so all requests fall into one window.
+	now := time.Now()
+	time.Sleep(now.Truncate(time.Second).Add(time.Second).Sub(now))
+
+	for i := 0; i < 3; i++ {
+		s, err := l.Allow("a", 3)
+		if err != nil {
+			t.Fatalf("Allow(%#v) error: %+v", "a", err)
+		}
+		if !s.Allowed || s.Remaining != 2-i {
+			t.Errorf("Allow(%#v) #%d return %+v", "a", i, s)
+		}
+	}
+
+	if s, _ := l.Allow("a", 3); s.Allowed || s.RetryAfter <= 0 {
+		t.Errorf("Allow(%#v) should reject the 4th request, got %+v", "a", s)
+	}
+
+	if s, _ := l.Allow("b", 3); !s.Allowed {
+		t.Errorf("Allow(%#v) should not share the quota of %#v", "b", "a")
+	}
+}
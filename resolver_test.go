@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/alecthomas/geoip"
 	"github.com/cloudflare/golibs/lrucache"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestRegionResolver(t *testing.T) {
@@ -34,3 +40,170 @@ func TestRegionResolver(t *testing.T) {
 		}
 	}
 }
+
+func TestRegionResolverRegions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regions")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "regions.csv")
+	ioutil.WriteFile(filename, []byte("# cidr,country,region\n8.0.0.0/8,US,CA\n8.8.0.0/16,US,NY\n8.8.8.0/24,us,ca\n2001:db8::/32,DE,BE\n"), 0644)
+
+	tree, err := LoadRegionTree(filename)
+	if err != nil {
+		t.Fatalf("LoadRegionTree(%#v) error: %+v", filename, err)
+	}
+
+	r := &RegionResolver{
+		Resolver: &Resolver{},
+		Regions:  tree,
+		Cache:    lrucache.NewLRUCache(2048),
+	}
+
+	var cases = [][3]string{
+		{"8.8.8.8", "US", "CA"},
+		{"8.8.4.4", "US", "NY"},
+		{"8.1.1.1", "US", "CA"},
+		{"1.1.1.1", "ZZ", ""},
+		{"2001:db8::1", "DE", "BE"},
+		{"[2001:db8::2]", "DE", "BE"},
+		{"::1", "", ""},
+		{"192.168.1.1", "", ""},
+		{"202.106.1.2", "ZZ", ""},
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, c := range cases {
+			if country, region, _ := r.LookupRegion(context.Background(), c[0]); country != c[1] || region != c[2] {
+				t.Errorf("LookupRegion(%#v) return %#v %#v, not match %#v %#v", c[0], country, region, c[1], c[2])
+			}
+		}
+	}
+}
+
+// fakeDNS is a local stand-in of a DNS server which answers A and PTR
+// questions from records, and the rcodes of failures for their names.
+type fakeDNS struct {
+	conn     net.PacketConn
+	records  map[string]string
+	failures map[string]dnsmessage.RCode
+}
+
+func newFakeDNS(t *testing.T, records map[string]string, failures map[string]dnsmessage.RCode) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket() error: %+v", err)
+	}
+
+	s := &fakeDNS{conn: conn, records: records, failures: failures}
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) == 0 {
+			continue
+		}
+
+		q := msg.Questions[0]
+		msg.Header.Response = true
+		msg.Header.Authoritative = true
+		msg.Header.RCode = dnsmessage.RCodeSuccess
+		if rcode, ok := s.failures[q.Name.String()]; ok {
+			msg.Header.RCode = rcode
+		} else if value, ok := s.records[q.Name.String()]; ok {
+			h := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+			switch q.Type {
+			case dnsmessage.TypePTR:
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(value)}})
+			case dnsmessage.TypeA:
+				var a [4]byte
+				copy(a[:], net.ParseIP(value).To4())
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: a}})
+			}
+		} else if q.Type != dnsmessage.TypeAAAA {
+			msg.Header.RCode = dnsmessage.RCodeNameError
+		}
+
+		if b, err := msg.Pack(); err == nil {
+			s.conn.WriteTo(b, addr)
+		}
+	}
+}
+
+func (s *fakeDNS) Resolver() *Resolver {
+	return &Resolver{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return net.Dial("udp", s.conn.LocalAddr().String())
+			},
+		},
+	}
+}
+
+func newTestFakeDNS(t *testing.T) *fakeDNS {
+	return newFakeDNS(t, map[string]string{
+		"4.2.0.192.in-addr.arpa.": "host.example.com.",
+		"host.example.com.":       "192.0.2.4",
+		"5.2.0.192.in-addr.arpa.": "spoof.example.com.",
+		"spoof.example.com.":      "198.51.100.1",
+	}, map[string]dnsmessage.RCode{
+		"7.2.0.192.in-addr.arpa.": dnsmessage.RCodeServerFailure,
+	})
+}
+
+func TestResolverLookupPTR(t *testing.T) {
+	dns := newTestFakeDNS(t)
+	defer dns.conn.Close()
+
+	r := dns.Resolver()
+	ctx := context.Background()
+
+	cases := []struct {
+		IP        string
+		Names     []string
+		Error     bool
+		Confirmed bool
+	}{
+		{"192.0.2.4", []string{"host.example.com"}, false, true},
+		{"192.0.2.5", []string{"spoof.example.com"}, false, false},
+		{"192.0.2.6", nil, false, false},
+		{"192.0.2.7", nil, true, false},
+	}
+
+	for _, c := range cases {
+		names, err := r.LookupPTR(ctx, c.IP)
+		if (err != nil) != c.Error || len(names) != len(c.Names) || (len(names) > 0 && names[0] != c.Names[0]) {
+			t.Errorf("LookupPTR(%#v) return %#v, %v, not match %#v", c.IP, names, err, c.Names)
+		}
+		if len(names) > 0 {
+			if ok := r.IsForwardConfirmed(ctx, net.ParseIP(c.IP), names[0]); ok != c.Confirmed {
+				t.Errorf("IsForwardConfirmed(%#v, %#v) return %#v, not match %#v", c.IP, names[0], ok, c.Confirmed)
+			}
+		}
+	}
+}
+
+func TestResolverIsForwardConfirmedStatic(t *testing.T) {
+	r := &Resolver{Resolver: &net.Resolver{}}
+	r.AddStaticHosts(strings.NewReader("192.0.2.9 static.example.com\n"))
+
+	if !r.IsForwardConfirmed(context.Background(), net.ParseIP("192.0.2.9"), "static.example.com") {
+		t.Errorf("IsForwardConfirmed() should confirm a static host")
+	}
+	if r.IsForwardConfirmed(context.Background(), net.ParseIP("192.0.2.10"), "static.example.com") {
+		t.Errorf("IsForwardConfirmed() should not confirm another ip")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+// WinRate is the count of bids, wins and losses of a placement.
+type WinRate struct {
+	Bids   int64 `json:"bids"`
+	Wins   int64 `json:"wins"`
+	Losses int64 `json:"losses"`
+}
+
+// Rate returns the fraction of bids won, or -1 without any bid.
+func (r WinRate) Rate() float64 {
+	if r.Bids == 0 {
+		return -1
+	}
+	return float64(r.Wins) / float64(r.Bids)
+}
+
+// WinRateTracker counts bids and notices of placements in hourly Set
+// records, and sums the hours of Window into a recent win rate.
+type WinRateTracker struct {
+	Store    BidStore
+	Set      string
+	Window   time.Duration
+	Cache    lrucache.Cache
+	CacheTTL time.Duration
+}
+
+// Placement returns the key of the publisher placement of imp.
+func Placement(req *BidRequest, imp *Imp) string {
+	var pub string
+	switch {
+	case req.Site != nil && req.Site.ID != "":
+		pub = "site:" + req.Site.ID
+	case req.Site != nil:
+		pub = "site:" + normalizeDomain(req.Site.Domain)
+	case req.App != nil && req.App.ID != "":
+		pub = "app:" + req.App.ID
+	case req.App != nil:
+		pub = "app:" + req.App.Bundle
+	}
+
+	tag := imp.TagID
+	if tag == "" {
+		tag = imp.ID
+	}
+
+	return pub + ":" + tag
+}
+
+func (t *WinRateTracker) key(placement string, hour time.Time) string {
+	return placement + ":" + strconv.FormatInt(hour.Unix(), 10)
+}
+
+// Record adds one to the bin ("bids", "wins" or "losses") of placement.
+func (t *WinRateTracker) Record(ctx context.Context, placement, bin string, now time.Time) error {
+	_, err := t.Store.Incr(ctx, t.Set, t.key(placement, now.Truncate(time.Hour)), bin, 1, t.Window+time.Hour)
+	return err
+}
+
+// WinRate returns the counts of placement over the recent Window.
+func (t *WinRateTracker) WinRate(ctx context.Context, placement string, now time.Time) (WinRate, error) {
+	if v, ok := t.Cache.GetNotStale(placement); ok {
+		return v.(WinRate), nil
+	}
+
+	var r WinRate
+	hour := now.Truncate(time.Hour)
+	for h := time.Duration(0); h < t.Window; h += time.Hour {
+		bins, err := t.Store.Get(ctx, t.Set, t.key(placement, hour.Add(-h)))
+		if err != nil {
+			return r, err
+		}
+		r.Bids += ToInt64(bins["bids"])
+		r.Wins += ToInt64(bins["wins"])
+		r.Losses += ToInt64(bins["losses"])
+	}
+
+	t.Cache.Set(placement, r, time.Now().Add(t.CacheTTL))
+
+	return r, nil
+}
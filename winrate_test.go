@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+func TestWinRateTracker(t *testing.T) {
+	tr := &WinRateTracker{
+		Store:    NewMemoryBidStore(),
+		Set:      "winrate",
+		Window:   2 * time.Hour,
+		Cache:    lrucache.NewLRUCache(100),
+		CacheTTL: time.Minute,
+	}
+
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+
+	// out of the window
+	tr.Record(ctx, "site:s1:t1", "bids", now.Add(-3*time.Hour))
+	for i := 0; i < 4; i++ {
+		tr.Record(ctx, "site:s1:t1", "bids", now.Add(-time.Duration(i)*20*time.Minute))
+	}
+	tr.Record(ctx, "site:s1:t1", "wins", now)
+	tr.Record(ctx, "site:s1:t1", "losses", now.Add(-time.Hour))
+
+	r, err := tr.WinRate(ctx, "site:s1:t1", now)
+	if err != nil {
+		t.Fatalf("WinRate() error: %+v", err)
+	}
+	if r != (WinRate{Bids: 4, Wins: 1, Losses: 1}) || r.Rate() != 0.25 {
+		t.Errorf("WinRate() return %#v, not match 1 of 4 bids", r)
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	cases := []struct {
+		Request   BidRequest
+		Placement string
+	}{
+		{BidRequest{Site: &Site{ID: "s1"}, Imp: []Imp{{ID: "1", TagID: "t1"}}}, "site:s1:t1"},
+		{BidRequest{Site: &Site{Domain: "www.example.com"}, Imp: []Imp{{ID: "1"}}}, "site:example.com:1"},
+		{BidRequest{App: &App{Bundle: "com.example"}, Imp: []Imp{{ID: "2", TagID: "t2"}}}, "app:com.example:t2"},
+	}
+
+	for _, c := range cases {
+		placement := Placement(&c.Request, &c.Request.Imp[0])
+		if placement != c.Placement {
+			t.Errorf("Placement(%#v) return %#v, not match %#v", c.Request, placement, c.Placement)
+		}
+	}
+}